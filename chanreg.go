@@ -0,0 +1,702 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ChanID is a small integer that identifies a channel, assigned in
+// the order that channels are first seen.  Mutexes and WaitGroups are
+// identified by ChanID's too, so that their operations line up with
+// channel operations in the events and traces.
+type ChanID int64
+
+// ChanInfo is what the registry knows about a channel, mutex or
+// WaitGroup.
+type ChanInfo struct {
+	ID     ChanID
+	Addr   uintptr
+	Name   string // Optional, see SetName() and Site.
+	Type   string // Ex: "chan int", or "sync.Mutex".
+	Elem   string // Ex: "int", or "" for a mutex or WaitGroup.
+	Len    int    // Sampled at the most recent operation, see Adders.
+	Cap    int
+	Closed bool
+
+	// Site is the "file.go:line" where the channel's name was
+	// declared, or else first used.
+	Site string
+
+	// Aliases are the other names that the channel has been used by,
+	// ex: "msg.ReplyCh" for a channel that was named "replyCh".
+	Aliases []string
+
+	// Tags are from NameChan(), and are not modified once set.
+	Tags Tags
+
+	// Creator, CreatorName, Created and CreatedTS describe the
+	// instrumented make(chan) that created the channel, if known.
+	Creator     GID
+	CreatorName string  // See GoroutineName().
+	Created     StackID // Where make(chan) was executed.
+	CreatedTS   int64   // Recorder timestamp.
+
+	// Holder is the goroutine that holds a mutex's (write) lock, and
+	// Readers hold an RWMutex's read locks, as known from the lock
+	// operations of instrumented code.
+	Holder  GID
+	Readers []GID
+
+	// For a WaitGroup, Len is its counter and Adders are the
+	// goroutines that are accountable for it, one entry per Add() that
+	// is not yet matched by a Done(), as known from the operations of
+	// instrumented code.  A goroutine that is spawned right after its
+	// parent's Add() takes over the parent's entry, see HandOff().
+	Adders []Adder
+}
+
+// Toucher records when a goroutine last sent to or received from a
+// channel.
+type Toucher struct {
+	GID GID
+	TS  int64 // Recorder timestamp.
+}
+
+// An Adder is a goroutine that owes a Done() to a WaitGroup.
+type Adder struct {
+	GID  GID
+	Name string // Or "" if the goroutine was not known, see LookupGoroutine().
+}
+
+// ---------------------------------------------------------------
+
+var DefaultChanRegistryShards = 64
+
+// DefaultChanTouchers is how many of the most recent senders and
+// receivers are remembered for each channel.
+var DefaultChanTouchers = 8
+
+// DefaultChanRegistryMaxChans is roughly the most channels, mutexes
+// and WaitGroups that a registry remembers, so that it does not grow
+// without bound as channels are created and garbage collected.
+var DefaultChanRegistryMaxChans = 100000
+
+// DefaultChanRegistry is the process-wide ChanRegistry.
+var DefaultChanRegistry = NewChanRegistry(DefaultChanRegistryShards)
+
+// A ChanRegistry assigns stable ChanID's to channels, and to the
+// *sync.Mutex, *sync.RWMutex and *sync.WaitGroup targets of the sync
+// operations.  It is sharded by address to avoid a global lock on
+// every operation.
+//
+// The registry does not hold references to channels, so a channel
+// that is garbage collected might have its address (and ChanID)
+// reused by a later channel, unless the later channel is created by
+// an instrumented make(chan), see Made().  When a shard is full, the
+// entries of closed channels and then the least recently used entries
+// are evicted, as they are the most likely to have been collected.
+type ChanRegistry struct {
+	lastID int64 // Accessed via atomic.
+	shards []chanShard
+	addrs  sync.Map // Keyed by ChanID, value is the channel's address.
+}
+
+type chanShard struct {
+	m     sync.Mutex
+	chans map[uintptr]*chanEntry
+	clock uint64 // Incremented on every use of an entry.
+}
+
+type chanEntry struct {
+	info      ChanInfo
+	senders   []Toucher // Most recent last.
+	receivers []Toucher // Most recent last.
+	used      uint64    // The shard's clock when last used.
+
+	// forgot is true once an older sender or receiver was dropped
+	// to make room for a more recent one.
+	forgot bool
+}
+
+// NewChanRegistry returns a ChanRegistry with the given number of
+// shards.
+func NewChanRegistry(numShards int) *ChanRegistry {
+	if numShards <= 0 {
+		numShards = 1
+	}
+	r := &ChanRegistry{shards: make([]chanShard, numShards)}
+	for i := range r.shards {
+		r.shards[i].chans = map[uintptr]*chanEntry{}
+	}
+	return r
+}
+
+func (r *ChanRegistry) shard(addr uintptr) *chanShard {
+	h := uint64(addr>>4) * 0x9E3779B97F4A7C15 // Fibonacci hashing.
+	return &r.shards[(h>>32)%uint64(len(r.shards))]
+}
+
+// Observe registers the channel if it's not already known, samples
+// its len() and cap(), and returns a copy of its ChanInfo.  The ok
+// result is false if ch is not a channel.
+func (r *ChanRegistry) Observe(ch interface{}) (info ChanInfo, ok bool) {
+	return r.ObserveSite(ch, nil)
+}
+
+// ObserveSite is like Observe, but also names the channel after the
+// source expression of the Site, if the channel has no name yet, or
+// else records the expression as an alias.
+func (r *ChanRegistry) ObserveSite(ch interface{},
+	site *Site) (info ChanInfo, ok bool) {
+	if ch == nil {
+		return info, false
+	}
+	v := reflect.ValueOf(ch)
+	if v.Kind() != reflect.Chan && !SyncTypes[v.Type()] {
+		return info, false
+	}
+	addr := v.Pointer()
+	if addr == 0 { // A nil channel, mutex or WaitGroup.
+		return info, false
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	info = r.observe(s, v, addr, site).info
+	s.m.Unlock()
+
+	return info, true
+}
+
+// observe registers, samples and names a channel while the shard is
+// locked.
+func (r *ChanRegistry) observe(s *chanShard, v reflect.Value, addr uintptr,
+	site *Site) *chanEntry {
+	c := s.chans[addr]
+	if c == nil {
+		r.evict(s)
+		c = &chanEntry{info: ChanInfo{
+			ID:   ChanID(atomic.AddInt64(&r.lastID, 1)),
+			Addr: addr,
+		}}
+		if v.Kind() == reflect.Chan {
+			c.info.Type = v.Type().String()
+			c.info.Elem = v.Type().Elem().String()
+		} else {
+			c.info.Type = v.Type().Elem().String() // Ex: "sync.Mutex".
+		}
+		s.chans[addr] = c
+		r.addrs.Store(c.info.ID, addr)
+	}
+	s.clock++
+	c.used = s.clock
+	if v.Kind() == reflect.Chan {
+		c.info.Len = v.Len()
+		c.info.Cap = v.Cap()
+	}
+	if site != nil && site.Expr != "" && site.Expr != c.info.Name {
+		if c.info.Name == "" {
+			c.info.Name = site.Expr
+			c.info.Site = site.Decl
+			if c.info.Site == "" {
+				c.info.Site = site.Pos
+			}
+		} else {
+			c.info.Aliases = addAlias(c.info.Aliases, site.Expr)
+		}
+	}
+	return c
+}
+
+// evict makes room in a full shard for a new entry, while the shard
+// is locked, by forgetting a quarter of its entries: those of closed
+// channels first, and then the least recently used.
+func (r *ChanRegistry) evict(s *chanShard) {
+	max := DefaultChanRegistryMaxChans / len(r.shards)
+	if max <= 0 {
+		max = 1
+	}
+	if len(s.chans) < max {
+		return
+	}
+
+	entries := make([]*chanEntry, 0, len(s.chans))
+	for _, c := range s.chans {
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].info.Closed != entries[j].info.Closed {
+			return entries[i].info.Closed
+		}
+		return entries[i].used < entries[j].used
+	})
+
+	for _, c := range entries[:len(entries)-max*3/4] {
+		r.forget(s, c.info.Addr)
+	}
+}
+
+// forget removes the entry at an address, if any, while the shard is
+// locked.
+func (r *ChanRegistry) forget(s *chanShard, addr uintptr) {
+	if c := s.chans[addr]; c != nil {
+		delete(s.chans, addr)
+		r.addrs.Delete(c.info.ID)
+	}
+}
+
+// Made registers a channel that was just created by an instrumented
+// make(chan), along with its creator.  As the channel is new, any
+// entry at the same address was of a channel that has been garbage
+// collected, so that entry is replaced, including its ChanID, name,
+// closed state and touchers.
+func (r *ChanRegistry) Made(ch interface{}, site *Site,
+	creator GID, created StackID, ts int64) (info ChanInfo, ok bool) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return info, false
+	}
+
+	creatorName := GoroutineName(creator)
+
+	s := r.shard(addr)
+	s.m.Lock()
+	r.forget(s, addr)
+	c := r.observe(s, reflect.ValueOf(ch), addr, site)
+	if c.info.Site == "" && site != nil {
+		c.info.Site = site.Pos
+	}
+	c.info.Creator = creator
+	c.info.CreatorName = creatorName
+	c.info.Created = created
+	c.info.CreatedTS = ts
+	info = c.info
+	s.m.Unlock()
+
+	return info, true
+}
+
+// SetName registers the channel if it's not already known, and gives
+// it a name, ex: for a SamplePolicy's ChanName.
+func (r *ChanRegistry) SetName(ch interface{}, name string) {
+	r.SetNameTags(ch, name, "", nil)
+}
+
+// SetNameTags registers the channel if it's not already known, and
+// gives it a name, unless the name is "", along with the "file.go:line"
+// site of the naming and the tags, unless the tags are nil.  The
+// previous name, if any, becomes an alias.
+func (r *ChanRegistry) SetNameTags(ch interface{}, name, site string,
+	tags Tags) (info ChanInfo, ok bool) {
+	if _, ok = r.Observe(ch); !ok {
+		return info, false
+	}
+
+	if tags != nil {
+		tags = tags.copy()
+	}
+
+	addr := ChanAddr(ch)
+
+	s := r.shard(addr)
+	s.m.Lock()
+	c := s.chans[addr]
+	if c != nil {
+		if name != "" && c.info.Name != name {
+			if c.info.Name != "" {
+				c.info.Aliases = addAlias(c.info.Aliases, c.info.Name)
+			}
+			c.info.Name = name
+			if site != "" {
+				c.info.Site = site
+			}
+		}
+		if tags != nil {
+			c.info.Tags = tags
+		}
+		info = c.info
+	}
+	s.m.Unlock()
+
+	return info, c != nil
+}
+
+// addAlias returns the aliases with the name, if not already.  The
+// aliases are copied on write, as ChanInfo copies share them.
+func addAlias(aliases []string, name string) []string {
+	for _, alias := range aliases {
+		if alias == name {
+			return aliases
+		}
+	}
+	return append(aliases[:len(aliases):len(aliases)], name)
+}
+
+// MarkClosed records that the channel has been closed.
+func (r *ChanRegistry) MarkClosed(ch interface{}) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		c.info.Closed = true
+	}
+	s.m.Unlock()
+}
+
+// Acquire records that a goroutine acquired a read lock or the
+// (write) lock of a registered mutex.
+func (r *ChanRegistry) Acquire(mu interface{}, gid GID, read bool) {
+	addr := ChanAddr(mu)
+	if addr == 0 {
+		return
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		if read {
+			c.info.Readers = append(c.info.Readers[:len(c.info.Readers):len(c.info.Readers)], gid)
+		} else {
+			c.info.Holder = gid
+		}
+	}
+	s.m.Unlock()
+}
+
+// Release records that a goroutine is about to release a read lock
+// or the (write) lock of a registered mutex.  As a mutex may be
+// unlocked by a goroutine other than the one that locked it, a read
+// lock of another goroutine is released if the goroutine has none.
+func (r *ChanRegistry) Release(mu interface{}, gid GID, read bool) {
+	addr := ChanAddr(mu)
+	if addr == 0 {
+		return
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		if read {
+			readers := c.info.Readers
+			if len(readers) > 0 {
+				i := 0
+				for j, reader := range readers {
+					if reader == gid {
+						i = j
+						break
+					}
+				}
+				// Copied on write, as ChanInfo copies share them.
+				c.info.Readers = append(readers[:i:i], readers[i+1:]...)
+			}
+		} else {
+			c.info.Holder = 0
+		}
+	}
+	s.m.Unlock()
+}
+
+// DefaultWaitGroupAdders is the most Adders that are remembered for
+// each WaitGroup, so that a large Add() is not costly.
+var DefaultWaitGroupAdders = 1024
+
+// WaitGroupAdd registers the WaitGroup if it's not already known, and
+// records that a goroutine added delta to its counter, where a
+// negative delta is like that many Done()'s.
+func (r *ChanRegistry) WaitGroupAdd(wg interface{}, adder Adder, delta int) {
+	if delta < 0 {
+		for ; delta < 0; delta++ {
+			r.WaitGroupDone(wg, adder.GID, 0)
+		}
+		return
+	}
+
+	addr := ChanAddr(wg)
+	if addr == 0 {
+		return
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	c := r.observe(s, reflect.ValueOf(wg), addr, nil)
+	c.info.Len += delta
+	adders := c.info.Adders[:len(c.info.Adders):len(c.info.Adders)]
+	for i := 0; i < delta && len(adders) < DefaultWaitGroupAdders; i++ {
+		adders = append(adders, adder)
+	}
+	c.info.Adders = adders
+	s.m.Unlock()
+}
+
+// WaitGroupDone registers the WaitGroup if it's not already known,
+// and records that a goroutine is about to decrement its counter.
+// The Adders entry that's removed is the goroutine's own, or else its
+// parent's (ex: when the parent spawned a goroutine that's not
+// instrumented), or else the oldest, and its GID is returned, or 0 if
+// there was no entry.
+func (r *ChanRegistry) WaitGroupDone(wg interface{}, gid, parent GID) (removed GID) {
+	addr := ChanAddr(wg)
+	if addr == 0 {
+		return 0
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	c := r.observe(s, reflect.ValueOf(wg), addr, nil)
+	c.info.Len--
+	if adders := c.info.Adders; len(adders) > 0 {
+		i := indexAdder(adders, gid)
+		if i < 0 && parent != 0 {
+			i = indexAdder(adders, parent)
+		}
+		if i < 0 {
+			i = 0
+		}
+		removed = adders[i].GID
+		// Copied on write, as ChanInfo copies share them.
+		c.info.Adders = append(adders[:i:i], adders[i+1:]...)
+	}
+	s.m.Unlock()
+
+	return removed
+}
+
+// HandOff moves one of the Adders entries of a registered WaitGroup
+// from a goroutine to another, returning false if the from goroutine
+// has no entry.
+func (r *ChanRegistry) HandOff(wg interface{}, from GID, to Adder) bool {
+	addr := ChanAddr(wg)
+	if addr == 0 {
+		return false
+	}
+
+	var ok bool
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		adders := c.info.Adders
+		if i := indexAdder(adders, from); i >= 0 {
+			adders = append([]Adder(nil), adders...)
+			adders[i] = to
+			c.info.Adders = adders
+			ok = true
+		}
+	}
+	s.m.Unlock()
+
+	return ok
+}
+
+func indexAdder(adders []Adder, gid GID) int {
+	for i, a := range adders {
+		if a.GID == gid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Touch records that a goroutine completed an operation on the
+// channel, remembering it as a recent sender or receiver.
+func (r *ChanRegistry) Touch(ch interface{}, gid GID, op Op, ts int64) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		s.clock++
+		c.used = s.clock
+		var forgot bool
+		if IsSendOp(op) {
+			c.senders, forgot = addToucher(c.senders, gid, ts)
+		} else if IsRecvOp(op) {
+			c.receivers, forgot = addToucher(c.receivers, gid, ts)
+		}
+		c.forgot = c.forgot || forgot
+	}
+	s.m.Unlock()
+}
+
+// addToucher returns the touchers with the goroutine as the most
+// recent, and whether an older toucher was dropped to make room.
+func addToucher(touchers []Toucher, gid GID, ts int64) ([]Toucher, bool) {
+	var forgot bool
+	for i, t := range touchers {
+		if t.GID == gid {
+			touchers = append(touchers[:i], touchers[i+1:]...)
+			break
+		}
+	}
+	if len(touchers) >= DefaultChanTouchers && len(touchers) > 0 {
+		touchers = append(touchers[:0], touchers[1:]...)
+		forgot = true
+	}
+	return append(touchers, Toucher{GID: gid, TS: ts}), forgot
+}
+
+// Touchers returns copies of the recent senders and receivers of a
+// channel, most recent last.
+func (r *ChanRegistry) Touchers(ch interface{}) (senders, receivers []Toucher) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return nil, nil
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		senders = append(senders, c.senders...)
+		receivers = append(receivers, c.receivers...)
+	}
+	s.m.Unlock()
+
+	return senders, receivers
+}
+
+// TouchersAll is like Touchers, but also returns whether the senders
+// and receivers are every goroutine that ever used the channel, which
+// is when the channel was created by an instrumented make(chan) and
+// none of its senders and receivers were forgotten since.
+func (r *ChanRegistry) TouchersAll(ch interface{}) (senders, receivers []Toucher,
+	all bool) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return nil, nil, false
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil {
+		senders = append(senders, c.senders...)
+		receivers = append(receivers, c.receivers...)
+		all = c.info.Creator != 0 && !c.forgot
+	}
+	s.m.Unlock()
+
+	return senders, receivers, all
+}
+
+// TouchersID is like Touchers, but of a registered channel's ChanID.
+func (r *ChanRegistry) TouchersID(id ChanID) (senders, receivers []Toucher) {
+	v, exists := r.addrs.Load(id)
+	if !exists {
+		return nil, nil
+	}
+	addr := v.(uintptr)
+
+	s := r.shard(addr)
+	s.m.Lock()
+	if c := s.chans[addr]; c != nil && c.info.ID == id {
+		senders = append(senders, c.senders...)
+		receivers = append(receivers, c.receivers...)
+	}
+	s.m.Unlock()
+
+	return senders, receivers
+}
+
+// Lookup returns a copy of the ChanInfo of a registered channel.
+func (r *ChanRegistry) Lookup(ch interface{}) (info ChanInfo, ok bool) {
+	addr := ChanAddr(ch)
+	if addr == 0 {
+		return info, false
+	}
+
+	s := r.shard(addr)
+	s.m.Lock()
+	c := s.chans[addr]
+	if c != nil {
+		info, ok = c.info, true
+	}
+	s.m.Unlock()
+
+	return info, ok
+}
+
+// LookupID returns a copy of the ChanInfo of a registered channel.
+func (r *ChanRegistry) LookupID(id ChanID) (info ChanInfo, ok bool) {
+	v, exists := r.addrs.Load(id)
+	if !exists {
+		return info, false
+	}
+	addr := v.(uintptr)
+
+	s := r.shard(addr)
+	s.m.Lock()
+	c := s.chans[addr]
+	if c != nil && c.info.ID == id {
+		info, ok = c.info, true
+	}
+	s.m.Unlock()
+
+	return info, ok
+}
+
+// Chans returns a copy of every registered ChanInfo, ordered by ID.
+func (r *ChanRegistry) Chans() []ChanInfo {
+	var rv []ChanInfo
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.m.Lock()
+		for _, c := range s.chans {
+			rv = append(rv, c.info)
+		}
+		s.m.Unlock()
+	}
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+
+	return rv
+}
+
+// ---------------------------------------------------------------
+
+// ChanAddr returns the identity of a channel, mutex or WaitGroup, or
+// 0 if the target is none of those.
+func ChanAddr(target interface{}) uintptr {
+	if target == nil {
+		return 0
+	}
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Chan && !SyncTypes[v.Type()] {
+		return 0
+	}
+	return v.Pointer()
+}
+
+// SyncTypes are the pointer types of the sync primitives that are
+// registered along with channels.
+var SyncTypes = map[reflect.Type]bool{
+	reflect.TypeOf((*sync.Mutex)(nil)):     true,
+	reflect.TypeOf((*sync.RWMutex)(nil)):   true,
+	reflect.TypeOf((*sync.WaitGroup)(nil)): true,
+}
+
+// SyncTypeNames are the ChanInfo Type's of the registered sync
+// primitives.
+var SyncTypeNames = map[string]bool{
+	"sync.Mutex":     true,
+	"sync.RWMutex":   true,
+	"sync.WaitGroup": true,
+}
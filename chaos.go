@@ -0,0 +1,186 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosOptions configures the schedule perturbation (chaos) mode,
+// which injects randomized runtime.Gosched() calls and short sleeps
+// before every instrumented channel operation, so that concurrency
+// bugs which need unusual interleavings show up more often.
+//
+// The decisions are derived from the Seed, the goroutine id and the
+// count of the goroutine's operations, so that a goroutine makes the
+// same decisions for the same seed, although the goroutine ids of
+// different runs might differ.
+type ChaosOptions struct {
+	Seed int64
+
+	// GoschedProb is the probability, between 0 and 1, of yielding
+	// the processor before an operation.
+	GoschedProb float64
+
+	// SleepProb is the probability of sleeping before an operation,
+	// for a random duration up to MaxSleep.
+	SleepProb float64
+	MaxSleep  time.Duration
+}
+
+var DefaultChaosOptions = ChaosOptions{
+	GoschedProb: 0.2,
+	SleepProb:   0.05,
+	MaxSleep:    time.Millisecond,
+}
+
+// ChaosSeedMetaKey is the trace metadata key of the chaos seed.
+var ChaosSeedMetaKey = "chaos-seed"
+
+var chaos atomic.Value // Holds a chaosRef.
+
+// chaosRef allows atomic.Value to hold a nil ChaosOptions.
+type chaosRef struct {
+	options *ChaosOptions
+}
+
+// StartChaos turns on the chaos mode, and records the seed in the
+// traces that are being streamed.
+func StartChaos(options ChaosOptions) {
+	chaos.Store(chaosRef{&options})
+
+	seed := strconv.FormatInt(options.Seed, 10)
+	for _, sink := range DefaultRecorder.Sinks() {
+		if s, ok := sink.(*TraceSink); ok {
+			s.WriteMeta(ChaosSeedMetaKey, seed)
+		}
+	}
+}
+
+// StopChaos turns off the chaos mode.
+func StopChaos() {
+	chaos.Store(chaosRef{})
+}
+
+// CurrentChaos returns a copy of the options of the chaos mode, or
+// nil if the chaos mode is off.
+func CurrentChaos() *ChaosOptions {
+	ref, _ := chaos.Load().(chaosRef)
+	if ref.options == nil {
+		return nil
+	}
+	options := *ref.options
+	return &options
+}
+
+func currentChaos() *ChaosOptions {
+	ref, _ := chaos.Load().(chaosRef)
+	return ref.options
+}
+
+// DefaultChaosMaxCounts is the most goroutines whose counts of
+// operations are remembered by the chaos mode.  The counts of the
+// goroutines spawned by instrumented go statements are forgotten when
+// they exit, and when there are still too many, every count restarts.
+var DefaultChaosMaxCounts = 100000
+
+// chaosCounts are the counts of each goroutine's operations, which
+// are kept per goroutine rather than per GCtx, so that a helper func
+// that's called in a loop does not repeat the same decisions.
+var chaosCounts = struct {
+	m      sync.Mutex
+	counts map[GID]uint64
+}{
+	counts: map[GID]uint64{},
+}
+
+// perturb might yield or sleep before an operation of a goroutine.
+func (o *ChaosOptions) perturb(gctx *GCtx) {
+	r := o.draw(gctx.GID)
+
+	p := float64(r>>11) / (1 << 53) // Uniform in [0, 1).
+
+	if p < o.SleepProb && o.MaxSleep > 0 {
+		time.Sleep(time.Duration(splitmix64(r) % uint64(o.MaxSleep)))
+	} else if p < o.SleepProb+o.GoschedProb {
+		runtime.Gosched()
+	}
+}
+
+// draw returns the random number of the next operation of a
+// goroutine.
+func (o *ChaosOptions) draw(gid GID) uint64 {
+	chaosCounts.m.Lock()
+	if len(chaosCounts.counts) >= DefaultChaosMaxCounts {
+		chaosCounts.counts = map[GID]uint64{}
+	}
+	n := chaosCounts.counts[gid] + 1
+	chaosCounts.counts[gid] = n
+	chaosCounts.m.Unlock()
+
+	return splitmix64(uint64(o.Seed) ^
+		splitmix64(uint64(gid)) ^
+		splitmix64(n+0x632BE59BD9B4E019))
+}
+
+// forgetChaosCount forgets the count of a goroutine that exited.
+func forgetChaosCount(gid GID) {
+	chaosCounts.m.Lock()
+	delete(chaosCounts.counts, gid)
+	chaosCounts.m.Unlock()
+}
+
+// splitmix64 is a fast, well mixing hash of a uint64.
+func splitmix64(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// ---------------------------------------------------------------
+
+// EnvChaos is the environment variable that turns on the chaos mode
+// with the DefaultChaosOptions when the process starts.  Its value is
+// the seed, or "random" for a seed from the clock, which is logged,
+// ex: GAPTURE_CHAOS=42.
+var EnvChaos = "GAPTURE_CHAOS"
+
+func init() {
+	v := os.Getenv(EnvChaos)
+	if v == "" {
+		return
+	}
+
+	options := DefaultChaosOptions
+
+	if v == "random" {
+		options.Seed = time.Now().UnixNano()
+	} else {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Printf("gapture: could not parse %s: %v", EnvChaos, err)
+			return
+		}
+		options.Seed = seed
+	}
+
+	log.Printf("gapture: chaos mode, seed: %d", options.Seed)
+
+	StartChaos(options)
+}
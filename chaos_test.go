@@ -0,0 +1,81 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"testing"
+)
+
+// chaosHelper is like an instrumented func, with its own GCtx, which
+// is called repeatedly by the same goroutine.
+func chaosHelper(o *ChaosOptions) uint64 {
+	var gctx GCtx
+	gctx.EnsureGID()
+	return o.draw(gctx.GID)
+}
+
+func chaosDraws(o *ChaosOptions, n int) []uint64 {
+	forgetChaosCount(CurrentGID())
+
+	var rv []uint64
+	for i := 0; i < n; i++ {
+		rv = append(rv, chaosHelper(o))
+	}
+	return rv
+}
+
+func TestChaosDrawsVaryAcrossCalls(t *testing.T) {
+	draws := chaosDraws(&ChaosOptions{Seed: 42}, 100)
+
+	seen := map[uint64]bool{}
+	for _, r := range draws {
+		seen[r] = true
+	}
+	if len(seen) != len(draws) {
+		t.Errorf("expected distinct draws, got: %d of %d", len(seen), len(draws))
+	}
+}
+
+func TestChaosDrawsDeterministic(t *testing.T) {
+	tests := []struct {
+		seedA, seedB int64
+		same         bool
+	}{
+		{42, 42, true},
+		{42, 43, false},
+		{0, 0, true},
+	}
+
+	for _, test := range tests {
+		a := chaosDraws(&ChaosOptions{Seed: test.seedA}, 20)
+		b := chaosDraws(&ChaosOptions{Seed: test.seedB}, 20)
+		if reflect.DeepEqual(a, b) != test.same {
+			t.Errorf("seeds %d and %d, expected same: %v, got: %v and %v",
+				test.seedA, test.seedB, test.same, a, b)
+		}
+	}
+}
+
+func TestChaosCountForgotten(t *testing.T) {
+	gid := GID(-100)
+	o := &ChaosOptions{Seed: 7}
+
+	first := o.draw(gid)
+	o.draw(gid)
+	forgetChaosCount(gid)
+
+	if got := o.draw(gid); got != first {
+		t.Errorf("expected the count to restart, got: %d, expected: %d", got, first)
+	}
+	forgetChaosCount(gid)
+}
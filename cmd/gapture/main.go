@@ -14,6 +14,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -26,6 +27,8 @@ import (
 	"golang.org/x/tools/go/loader"
 
 	"github.com/couchbaselabs/gapture/convert"
+	"github.com/couchbaselabs/gapture/export"
+	"github.com/couchbaselabs/gapture/trace"
 )
 
 type Cmd struct {
@@ -37,6 +40,7 @@ var Cmds = map[string]Cmd{}
 
 type Flags struct {
 	BuildTags string
+	Format    string
 	Help      bool
 	Test      bool
 	Verbose   int
@@ -71,6 +75,10 @@ func init() {
 		[]string{"buildTags"}, "BUILD_TAGS]", "",
 		"optional, space-separated build tags")
 
+	s(&flags.Format,
+		[]string{"format"}, "FORMAT]", "chrome",
+		"export format: chrome, dot, mermaid, plantuml")
+
 	b(&flags.Help,
 		[]string{"help", "h", "?"}, "", false,
 		"print this help message and exit")
@@ -90,6 +98,11 @@ func init() {
 		"build the instrumented code",
 	}
 
+	Cmds["export"] = Cmd{
+		CmdExport,
+		"export a trace file to another format",
+	}
+
 	Cmds["help"] = Cmd{
 		CmdHelp,
 		"print this help message and exit",
@@ -119,6 +132,7 @@ func CmdHelp(args []string) {
 		`gapture - tool for goroutine runtime behavior capture
 
 Usage: gapture CMD [OPTIONS]
+       gapture export [--format=FORMAT] TRACE_FILE
 
 Supported CMD's:`)
 
@@ -201,6 +215,46 @@ func CmdBuild(args []string) {
 	_ = argsRest // TODO.
 }
 
+// ---------------------------------------------
+
+// Exporters are the supported export formats, keyed by format name.
+var Exporters = map[string]func(*trace.Reader, io.Writer) error{
+	"chrome":   export.Chrome,
+	"dot":      export.Dot,
+	"mermaid":  export.Mermaid,
+	"plantuml": export.PlantUML,
+}
+
+func CmdExport(args []string) {
+	flagSet.Parse(args)
+
+	if flags.Help || flagSet.NArg() != 1 {
+		CmdHelp(args)
+		return
+	}
+
+	exporter, exists := Exporters[flags.Format]
+	if !exists {
+		log.Fatalf("main: CmdExport, unknown format: %s", flags.Format)
+	}
+
+	f, err := os.Open(flagSet.Arg(0))
+	if err != nil {
+		log.Fatalf("main: CmdExport, os.Open, err: %v", err)
+	}
+	defer f.Close()
+
+	r, err := trace.NewReader(f)
+	if err != nil {
+		log.Fatalf("main: CmdExport, trace.NewReader, err: %v", err)
+	}
+
+	err = exporter(r, os.Stdout)
+	if err != nil {
+		log.Fatalf("main: CmdExport, exporter, err: %v", err)
+	}
+}
+
 // MakeIndentationLogf returns a logger function that uses message
 // indentation to determine the logging level of the message.
 func MakeIndentationLogf(level int) func(fmt string, v ...interface{}) {
@@ -17,8 +17,11 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"golang.org/x/tools/astutil"
 	"golang.org/x/tools/go/loader"
@@ -35,7 +38,7 @@ var RuntimeVarName = RuntimePackage + RuntimeVarType
 // initialization stmt's in rewritten func bodies, in order to declare
 // required vars.
 func RuntimeFuncPrefix() []ast.Stmt {
-	// Equivalent to "var $RuntimeVarName = $RuntimePackage.$RuntimeVarType".
+	// Equivalent to "var $RuntimeVarName $RuntimePackage.$RuntimeVarType".
 	return []ast.Stmt{
 		&ast.DeclStmt{
 			Decl: &ast.GenDecl{
@@ -45,11 +48,9 @@ func RuntimeFuncPrefix() []ast.Stmt {
 						Names: []*ast.Ident{
 							&ast.Ident{Name: RuntimeVarName},
 						},
-						Values: []ast.Expr{
-							&ast.SelectorExpr{
-								X:   &ast.Ident{Name: RuntimePackage},
-								Sel: &ast.Ident{Name: RuntimeVarType},
-							},
+						Type: &ast.SelectorExpr{
+							X:   &ast.Ident{Name: RuntimePackage},
+							Sel: &ast.Ident{Name: RuntimeVarType},
 						},
 					},
 				},
@@ -90,6 +91,8 @@ func ProcessProgram(prog *loader.Program, options Options) (
 				file: file,
 				logf: logf,
 				node: file,
+
+				sites: map[string]bool{},
 			}
 
 			fileName := prog.Fset.Position(file.Pos()).Filename
@@ -137,31 +140,213 @@ func UsesChannels(info *types.Info, topNode ast.Node) bool {
 	rv := false
 
 	ast.Inspect(topNode, func(node ast.Node) bool {
-		switch x := node.(type) {
-		case *ast.SendStmt:
-			rv = true
-		case *ast.UnaryExpr:
-			if x.Op == token.ARROW {
-				rv = true
-			}
-		case *ast.SelectStmt:
-			rv = true
-		case *ast.CallExpr:
-			ident, ok := x.Fun.(*ast.Ident)
-			if ok && ident.Name == "close" {
-				rv = true
-			}
-		case *ast.RangeStmt:
-			t := info.TypeOf(x.X)
-			rv = strings.HasPrefix(t.String(), "chan ")
+		rv = rv || IsChannelOp(info, node)
+
+		return rv == false
+	})
+
+	return rv
+}
+
+// IsChannelOp returns true if the ast.Node itself, not counting its
+// children, is a channel operation that's instrumented.
+func IsChannelOp(info *types.Info, node ast.Node) bool {
+	switch x := node.(type) {
+	case *ast.SendStmt:
+		return true
+	case *ast.UnaryExpr:
+		return x.Op == token.ARROW
+	case *ast.SelectStmt:
+		return true
+	case *ast.CallExpr:
+		ident, ok := x.Fun.(*ast.Ident)
+		return ok && ident.Name == "close"
+	case *ast.RangeStmt:
+		t := info.TypeOf(x.X)
+		return strings.HasPrefix(t.String(), "chan ")
+	}
+	return false
+}
+
+// UsesRuntime returns true if a func needs the runtime var, as it
+// uses channels or mutexes, or has go statements that can be
+// instrumented.  The func literals nested in the func are not
+// counted, as they declare their own runtime var.
+func UsesRuntime(info *types.Info, pkg *types.Package, funcNode ast.Node) bool {
+	rv := false
+
+	ast.Inspect(funcNode, func(node ast.Node) bool {
+		if x, ok := node.(*ast.FuncLit); ok && x != funcNode {
+			return false
 		}
 
+		if x, ok := node.(*ast.GoStmt); ok {
+			rv = rv || GoFuncType(info, x.Call) != nil
+		}
+
+		if x, ok := node.(*ast.CallExpr); ok {
+			hook, _, _ := SyncHook(info, pkg, x)
+			rv = rv || hook != ""
+		}
+
+		rv = rv || IsChannelOp(info, node)
+
 		return rv == false
 	})
 
 	return rv
 }
 
+// GoFuncType returns the type of the func value of a go statement's
+// call, or nil if the go statement can't be instrumented, ex: the
+// "go println(x)" of a builtin.
+func GoFuncType(info *types.Info, call *ast.CallExpr) types.Type {
+	tv, exists := info.Types[call.Fun]
+	if !exists || tv.IsBuiltin() || tv.IsType() || tv.Type == nil {
+		return nil
+	}
+	if _, ok := tv.Type.Underlying().(*types.Signature); !ok {
+		return nil
+	}
+	return tv.Type
+}
+
+// SyncHooks are the runtime hooks of the sync.Mutex, sync.RWMutex and
+// sync.WaitGroup methods, keyed by "Type.Method".
+var SyncHooks = map[string]string{
+	"Mutex.Lock":      "OnMuLock",
+	"Mutex.Unlock":    "OnMuUnlock",
+	"RWMutex.Lock":    "OnRWLock",
+	"RWMutex.Unlock":  "OnRWUnlock",
+	"RWMutex.RLock":   "OnRWRLock",
+	"RWMutex.RUnlock": "OnRWRUnlock",
+	"WaitGroup.Add":   "OnWGAdd",
+	"WaitGroup.Done":  "OnWGDone",
+	"WaitGroup.Wait":  "OnWGWait",
+}
+
+// SyncHook returns the runtime hook of a method call on a sync.Mutex,
+// sync.RWMutex or sync.WaitGroup, and an expr of the receiver, where
+// isPtr is true if the expr is a pointer, or "" if the call is not an
+// instrumented sync method.  The method may be promoted from embedded
+// fields, which are spelled out in the returned expr, ex: "s.Mutex"
+// for "s.Lock()", so they must be accessible from the pkg.
+func SyncHook(info *types.Info, pkg *types.Package,
+	call *ast.CallExpr) (hook string, target ast.Expr, isPtr bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", nil, false
+	}
+	selection := info.Selections[sel]
+	if selection == nil || selection.Kind() != types.MethodVal {
+		return "", nil, false
+	}
+	fn, ok := selection.Obj().(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "sync" {
+		return "", nil, false
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return "", nil, false
+	}
+	recvType := recv.Type()
+	if p, ok := recvType.(*types.Pointer); ok {
+		recvType = p.Elem()
+	}
+	named, ok := recvType.(*types.Named)
+	if !ok {
+		return "", nil, false // Ex: a sync.Locker interface.
+	}
+	hook = SyncHooks[named.Obj().Name()+"."+fn.Name()]
+	if hook == "" {
+		return "", nil, false
+	}
+
+	// Spell out the embedded fields that the method is promoted from.
+	target = sel.X
+	t := selection.Recv()
+	index := selection.Index()
+	for _, i := range index[:len(index)-1] {
+		if p, ok := t.Underlying().(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok {
+			return "", nil, false
+		}
+		field := st.Field(i)
+		if !field.Exported() && field.Pkg() != pkg {
+			return "", nil, false // Not accessible from this package.
+		}
+		target = &ast.SelectorExpr{X: target, Sel: &ast.Ident{Name: field.Name()}}
+		t = field.Type()
+	}
+
+	_, isPtr = t.Underlying().(*types.Pointer)
+
+	return hook, target, isPtr
+}
+
+// MakeChanType returns the type of the channel made by a call of the
+// builtin make(), or nil if the call is not a make(chan).
+func MakeChanType(info *types.Info, call *ast.CallExpr) types.Type {
+	ident, ok := call.Fun.(*ast.Ident)
+	if !ok || ident.Name != "make" || len(call.Args) < 1 {
+		return nil
+	}
+	if _, ok := info.Uses[ident].(*types.Builtin); !ok {
+		return nil
+	}
+	t := info.TypeOf(call)
+	if t == nil {
+		return nil
+	}
+	if _, ok := t.Underlying().(*types.Chan); !ok {
+		return nil
+	}
+	return t
+}
+
+// MakeNameExpr returns the var or field that a make(chan) call is
+// directly assigned to by its parent node, ex: the "subtasks" of
+// "subtasks := make(chan int)", or nil.
+func MakeNameExpr(info *types.Info, parent ast.Node, call ast.Expr) ast.Expr {
+	var rv ast.Expr
+
+	switch n := parent.(type) {
+	case *ast.AssignStmt:
+		if len(n.Lhs) == len(n.Rhs) {
+			for i, rhs := range n.Rhs {
+				if rhs == call {
+					rv = n.Lhs[i]
+				}
+			}
+		}
+
+	case *ast.ValueSpec:
+		if len(n.Names) == len(n.Values) {
+			for i, value := range n.Values {
+				if value == call {
+					rv = n.Names[i]
+				}
+			}
+		}
+
+	case *ast.KeyValueExpr:
+		if n.Value == call {
+			rv = n.Key
+		}
+	}
+
+	if ident, ok := rv.(*ast.Ident); ok && ident.Name == "_" {
+		return nil
+	}
+	if rv == nil || ExprVar(info, rv) == nil {
+		return nil // Ex: the key of a map literal.
+	}
+	return rv
+}
+
 // ----------------------------------------------------------------
 
 // A Converter implements the ast.Visitor interface to instrument code
@@ -176,6 +361,8 @@ type Converter struct {
 	node   ast.Node
 
 	modifications int // Count of modifications made to this subtree.
+
+	sites map[string]bool // Shared by the file, the declared Site vars.
 }
 
 var indent = "......................................................"
@@ -189,6 +376,7 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 		file:   v.file,
 		logf:   v.logf,
 		node:   childNode,
+		sites:  v.sites,
 	}
 
 	if childNode != nil {
@@ -202,13 +390,13 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 		switch x := childNode.(type) {
 		case *ast.FuncDecl:
 			msg = fmt.Sprintf(" name: %v", x.Name)
-			if UsesChannels(v.info, x) {
+			if UsesRuntime(v.info, v.pkg, x) {
 				x.Body.List = InsertStmts(x.Body.List, 0, RuntimeFuncPrefix())
 				vChild.MarkModified()
 			}
 
 		case *ast.FuncLit:
-			if UsesChannels(v.info, x) {
+			if UsesRuntime(v.info, v.pkg, x) {
 				x.Body.List = InsertStmts(x.Body.List, 0, RuntimeFuncPrefix())
 				vChild.MarkModified()
 			}
@@ -219,7 +407,7 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 				// Convert:
 				//   close(chExpr)
 				// Into:
-				//   close(gaptureGCtx.OnChanClose(chExpr).(chan foo))
+				//   close(gaptureGCtx.OnChanClose(gaptureSite_f_1_2, chExpr).(chan foo))
 				//   gaptureGCtx.OnChanCloseDone()
 				//
 				x.Args = []ast.Expr{
@@ -228,7 +416,7 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 							Fun: &ast.Ident{
 								Name: RuntimeVarName + ".OnChanClose",
 							},
-							Args: x.Args,
+							Args: []ast.Expr{v.SiteExpr(x.Args[0]), x.Args[0]},
 						},
 						Type: &ast.Ident{
 							Name: types.TypeString(v.pkg, v.info.TypeOf(x.Args[0])),
@@ -249,21 +437,88 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 				vChild.MarkModified()
 			}
 
+			if hook, target, isPtr := SyncHook(v.info, v.pkg, x); hook != "" {
+				// Convert:
+				//   s.mu.Lock()
+				//   wg.Add(n)
+				// Into:
+				//   gaptureGCtx.OnMuLock(gaptureSite_f_1_2, &s.mu)
+				//   gaptureGCtx.OnWGAdd(gaptureSite_f_3_4, &wg, n)
+				//
+				// The hook performs the operation itself, so a
+				// "defer s.mu.Unlock()" works as before.
+				site := v.SiteExpr(target)
+				if !isPtr {
+					target = &ast.UnaryExpr{Op: token.AND, X: target}
+				}
+
+				x.Fun = &ast.Ident{Name: RuntimeVarName + "." + hook}
+				x.Args = append([]ast.Expr{site, target}, x.Args...)
+
+				vChild.MarkModified()
+			}
+
+			if t := MakeChanType(v.info, x); t != nil {
+				// Convert:
+				//   subtasks := make(chan foo, n)
+				// Into:
+				//   subtasks := gapture.OnMakeChan(gaptureMakeSite_f_1_2, make(chan foo, n)).(chan foo)
+				//
+				// OnMakeChan is a package func, so this also works in
+				// package level var initializers, which have no
+				// runtime var.
+				replacement := v.ValueAssertExpr(&ast.CallExpr{
+					Fun: &ast.Ident{Name: RuntimePackage + ".OnMakeChan"},
+					Args: []ast.Expr{
+						v.MakeSiteExpr(x, MakeNameExpr(v.info, v.node, x)),
+						x,
+					},
+				}, t)
+
+				v.ReplaceChildExpr(x, replacement)
+
+				vChild.MarkModified()
+			}
+
+		case *ast.GoStmt:
+			if t := GoFuncType(v.info, x.Call); t != nil {
+				// Convert:
+				//   go fExpr(args)
+				// Into:
+				//   go gaptureGCtx.OnGo(fExpr).(func(foo))(args)
+				//
+				// So the args are still evaluated by the parent.
+				x.Call.Fun = &ast.TypeAssertExpr{
+					X: &ast.CallExpr{
+						Fun: &ast.Ident{
+							Name: RuntimeVarName + ".OnGo",
+						},
+						Args: []ast.Expr{x.Call.Fun},
+					},
+					Type: &ast.Ident{
+						Name: types.TypeString(v.pkg, t),
+					},
+				}
+
+				vChild.MarkModified()
+			}
+
 		case *ast.SendStmt:
 			// Convert:
 			//   chExpr <- msgExpr
 			// Into:
-			//   gaptureGCtx.OnChanSend(chExpr).(chan foo) <- msgExpr
+			//   gaptureGCtx.OnChanSend(gaptureSite_f_1_2, chExpr).(chan foo) <-
+			//     gaptureGCtx.OnChanSendValue(msgExpr).(foo)
 			//   gaptureGCtx.OnChanSendDone()
 			//
 			funName := RuntimeVarName + ".OnChanSend"
-			var argsOp []ast.Expr
+			argsOp := []ast.Expr{v.SiteExpr(x.Chan)}
 
 			commClause, commClausePos := v.PartOfSelectCommClause()
 			if commClause != nil {
 				funName = RuntimeVarName + ".OnChanSelectSend"
 				posName := fmt.Sprintf("%d", commClausePos)
-				argsOp = []ast.Expr{&ast.Ident{Name: posName}}
+				argsOp = append(argsOp, &ast.Ident{Name: posName})
 
 				commClause.Body = InsertStmts(commClause.Body, 0, []ast.Stmt{
 					&ast.ExprStmt{
@@ -283,6 +538,10 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 				})
 			}
 
+			if chanType, ok := v.info.TypeOf(x.Chan).Underlying().(*types.Chan); ok {
+				x.Value = v.SendValueExpr(x.Value, chanType.Elem())
+			}
+
 			x.Chan = &ast.TypeAssertExpr{
 				X: &ast.CallExpr{
 					Fun:  &ast.Ident{Name: funName},
@@ -299,47 +558,112 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 			// Convert:
 			//   x, ok := <-chExpr
 			// Into:
-			//   x, ok := <-gaptureGCtx.OnChanRecv(chExpr).(chan foo))
-			//   gaptureGCtx.OnChanRecvDone(nil)
+			//   x, ok := <-gaptureGCtx.OnChanRecv(gaptureSite_f_1_2, chExpr).(chan foo))
+			//   gaptureGCtx.OnChanRecvOkDone(x, ok)
+			//
+			// Convert:
+			//   if x, ok := <-chExpr; ok { ... }
+			// Into:
+			//   if x, ok := <-gaptureGCtx.OnChanRecv(gaptureSite_f_1_2, chExpr).(chan foo)); ok {
+			//     gaptureGCtx.OnChanRecvOkDone(x, ok)
+			//     ...
+			//   } else {
+			//     gaptureGCtx.OnChanRecvOkDone(x, ok)
+			//   }
 			//
 			// Convert:
 			//   <-chExpr
 			// Into:
 			//   gaptureGCtx.OnChanRecvDone(
-			//     <-gaptureGCtx.OnChanRecv(chExpr).(chan foo))).(foo)
+			//     <-gaptureGCtx.OnChanRecv(gaptureSite_f_1_2, chExpr).(chan foo))).(foo)
 			//
 			if x.Op == token.ARROW {
 				funName := RuntimeVarName + ".OnChanRecv"
-				var argsOp []ast.Expr
+				argsOp := []ast.Expr{v.SiteExpr(x.X)}
+
+				if assignStmt, ok := v.node.(*ast.AssignStmt); ok {
+					valueIdent := AssignedIdent(assignStmt, x)
+					okIdent := AssignedOkIdent(assignStmt, x)
+
+					valueArg := ast.Expr(&ast.Ident{Name: "nil"})
+					if valueIdent != nil {
+						valueArg = &ast.Ident{Name: valueIdent.Name}
+					}
 
-				if _, ok := v.node.(*ast.AssignStmt); ok {
 					commClause, commClausePos := v.PartOfSelectCommClause()
 					if commClause != nil {
 						funName = RuntimeVarName + ".OnChanSelectRecv"
 						posName := fmt.Sprintf("%d", commClausePos)
-						argsOp = []ast.Expr{&ast.Ident{Name: posName}}
+						argsOp = append(argsOp, &ast.Ident{Name: posName})
+
+						doneName := funName + "Done"
+						doneArgs := []ast.Expr{&ast.Ident{Name: posName}}
+						if okIdent != nil {
+							doneName = funName + "OkDone"
+							doneArgs = append(doneArgs, valueArg,
+								&ast.Ident{Name: okIdent.Name})
+						} else if valueIdent != nil {
+							doneName = funName + "ValueDone"
+							doneArgs = append(doneArgs, valueArg)
+						}
 
 						commClause.Body = InsertStmts(commClause.Body, 0, []ast.Stmt{
 							&ast.ExprStmt{
 								X: &ast.CallExpr{
-									Fun: &ast.Ident{Name: funName + "Done"},
-									Args: []ast.Expr{
-										&ast.Ident{Name: posName},
-									},
+									Fun:  &ast.Ident{Name: doneName},
+									Args: doneArgs,
 								},
 							},
 						})
 					} else {
-						vChild.InsertStmtsAfter([]ast.Stmt{
-							&ast.ExprStmt{
-								X: &ast.CallExpr{
-									Fun: &ast.Ident{Name: funName + "Done"},
-									Args: []ast.Expr{
-										&ast.Ident{Name: "nil"},
+						doneStmts := func(known bool) []ast.Stmt {
+							doneName := funName + "Done"
+							doneArgs := []ast.Expr{&ast.Ident{Name: "nil"}}
+							if known {
+								doneArgs = []ast.Expr{valueArg}
+								if okIdent != nil {
+									doneName = funName + "OkDone"
+									doneArgs = append(doneArgs,
+										&ast.Ident{Name: okIdent.Name})
+								}
+							}
+							return []ast.Stmt{
+								&ast.ExprStmt{
+									X: &ast.CallExpr{
+										Fun:  &ast.Ident{Name: doneName},
+										Args: doneArgs,
 									},
 								},
-							},
-						})
+							}
+						}
+
+						// The assigned vars are only in scope after the
+						// stmt when the stmt is directly in a block, or
+						// in the branches of an if, switch or for stmt
+						// when the stmt is its init.
+						if _, ok := v.parent.node.(*ast.BlockStmt); ok {
+							vChild.InsertStmtsAfter(doneStmts(true))
+						} else if forStmt, ok := v.parent.node.(*ast.ForStmt); ok &&
+							forStmt.Post == assignStmt {
+							// A for stmt's post runs right before the
+							// next iteration, unless the cond ends the
+							// loop.  A post that repeats the init's
+							// receive shares the init's done stmts.
+							if !HasStmtsPrefix(forStmt.Body.List, doneStmts(true)) {
+								forStmt.Body.List = InsertStmts(forStmt.Body.List,
+									0, doneStmts(true))
+								vChild.InsertStmtsAfter(doneStmts(false))
+							}
+						} else if InsertInitDoneStmts(v.parent.node, assignStmt,
+							func() []ast.Stmt { return doneStmts(true) }) {
+							// A for stmt's init might not be followed
+							// by an iteration.
+							if _, ok := v.parent.node.(*ast.ForStmt); ok {
+								vChild.InsertStmtsAfter(doneStmts(false))
+							}
+						} else {
+							vChild.InsertStmtsAfter(doneStmts(false))
+						}
 					}
 
 					x.X = &ast.TypeAssertExpr{
@@ -361,12 +685,13 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 					chanElemType := chanType.Elem()
 
 					ast.Walk(&Converter{
-						info: vChild.info,
-						pkg:  vChild.pkg,
-						fset: vChild.fset,
-						file: vChild.file,
-						logf: vChild.logf,
-						node: x.X,
+						info:  vChild.info,
+						pkg:   vChild.pkg,
+						fset:  vChild.fset,
+						file:  vChild.file,
+						logf:  vChild.logf,
+						node:  x.X,
+						sites: vChild.sites,
 					}, x.X)
 
 					x.X = &ast.TypeAssertExpr{
@@ -379,16 +704,18 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 						},
 					}
 
-					childNode = v.ReplaceChildExpr(x,
-						&ast.TypeAssertExpr{
-							X: &ast.CallExpr{
-								Fun:  &ast.Ident{Name: RuntimeVarName + ".OnChanRecvDone"},
-								Args: []ast.Expr{x},
-							},
-							Type: &ast.Ident{
-								Name: types.TypeString(v.pkg, chanElemType),
-							},
-						})
+					var replacement ast.Expr = &ast.CallExpr{
+						Fun:  &ast.Ident{Name: RuntimeVarName + ".OnChanRecvDone"},
+						Args: []ast.Expr{x},
+					}
+
+					// A "<-chExpr" stmt discards the value, and an
+					// unused type assertion would not compile.
+					if _, ok := v.node.(*ast.ExprStmt); !ok {
+						replacement = v.ValueAssertExpr(replacement, chanElemType)
+					}
+
+					childNode = v.ReplaceChildExpr(x, replacement)
 
 					vChild.node = childNode
 
@@ -409,9 +736,9 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 			//   }
 			// Into:
 			//   select {
-			//   case msg := <-gaptureGCtx.OnChanSelectRecv(0, recvCh).(chan foo):
+			//   case msg := <-gaptureGCtx.OnChanSelectRecv(gaptureSite_f_1_2, 0, recvCh).(chan foo):
 			//     gaptureGCtx.OnChanSelectRecvDone(0)
-			//   case gaptureGCtx.OnChanSelectSend(1, chExpr).(chan foo) <- msgExpr:
+			//   case gaptureGCtx.OnChanSelectSend(gaptureSite_f_3_4, 1, chExpr).(chan foo) <- msgExpr:
 			//     gaptureGCtx.OnChanSelectSendDone(1)
 			//   default:
 			//     gaptureGCtx.OnChanSelectDefault()
@@ -441,8 +768,8 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 			// Convert:
 			//   for msg := range chExpr { ... }
 			// Info:
-			//   for msg := range gaptureGCtx.OnChanRange(chExpr).(chan foo) {
-			//     gaptureRangeCh1234 := gaptureGCtx.OnChanRangeBody()
+			//   for msg := range gaptureGCtx.OnChanRange(gaptureSite_f_1_2, chExpr).(chan foo) {
+			//     gaptureRangeCh1234 := gaptureGCtx.OnChanRangeBody(msg)
 			//     ...
 			//     ISSUE: any continue's here skip the OnChanRangeBodyLoop!!!
 			//     ...
@@ -458,7 +785,7 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 				x.X = &ast.TypeAssertExpr{
 					X: &ast.CallExpr{
 						Fun:  &ast.Ident{Name: funName},
-						Args: []ast.Expr{x.X},
+						Args: []ast.Expr{v.SiteExpr(x.X), x.X},
 					},
 					Type: &ast.Ident{Name: xTypeString},
 				}
@@ -468,12 +795,20 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 					position.Line,
 					position.Column)
 
+				// The received value is passed when it's assigned to
+				// a var, as other exprs might have side effects.
+				valueArg := ast.Expr(&ast.Ident{Name: "nil"})
+				if key, ok := x.Key.(*ast.Ident); ok && key.Name != "_" {
+					valueArg = &ast.Ident{Name: key.Name}
+				}
+
 				x.Body.List = InsertStmts(x.Body.List, 0, []ast.Stmt{
 					&ast.AssignStmt{
 						Lhs: []ast.Expr{&ast.Ident{Name: rangeChVarName}},
 						Tok: token.DEFINE,
 						Rhs: []ast.Expr{&ast.CallExpr{
-							Fun: &ast.Ident{Name: funName + "Body"},
+							Fun:  &ast.Ident{Name: funName + "Body"},
+							Args: []ast.Expr{valueArg},
 						}},
 					},
 				})
@@ -514,6 +849,221 @@ func (v *Converter) Visit(childNode ast.Node) ast.Visitor {
 	return vChild
 }
 
+// SiteExpr returns an expr of the static Site descriptor of a channel
+// operation on chExpr, declaring the Site as a package level var of
+// the file if not already, ex:
+//
+//   var gaptureSite_worker_42_7 = &gapture.Site{
+//     Expr: "subtasks", Pos: "worker.go:42", Decl: "worker.go:30"}
+func (v *Converter) SiteExpr(chExpr ast.Expr) ast.Expr {
+	return v.siteExpr("Site", chExpr, chExpr)
+}
+
+// MakeSiteExpr returns an expr of the static Site descriptor of a
+// make(chan) call, where nameExpr is what the new channel is assigned
+// to, or nil, ex:
+//
+//   var gaptureMakeSite_worker_30_14 = &gapture.Site{
+//     Expr: "subtasks", Pos: "worker.go:30", Decl: "worker.go:30"}
+func (v *Converter) MakeSiteExpr(makeExpr, nameExpr ast.Expr) ast.Expr {
+	return v.siteExpr("MakeSite", makeExpr, nameExpr)
+}
+
+func (v *Converter) siteExpr(kind string, posExpr, nameExpr ast.Expr) ast.Expr {
+	if v.sites == nil {
+		return &ast.Ident{Name: "nil"}
+	}
+
+	position := v.fset.Position(posExpr.Pos())
+
+	siteVarName := fmt.Sprintf(RuntimePackage+kind+"_%s_%d_%d",
+		SiteFileName(position.Filename), position.Line, position.Column)
+
+	if !v.sites[siteVarName] {
+		v.sites[siteVarName] = true
+
+		expr, decl := "", ""
+		if nameExpr != nil {
+			expr = types.ExprString(nameExpr)
+
+			obj := ExprVar(v.info, nameExpr)
+			if obj != nil && obj.Pos().IsValid() {
+				declPosition := v.fset.Position(obj.Pos())
+				decl = fmt.Sprintf("%s:%d",
+					filepath.Base(declPosition.Filename), declPosition.Line)
+			}
+		}
+
+		field := func(key, val string) ast.Expr {
+			return &ast.KeyValueExpr{
+				Key:   &ast.Ident{Name: key},
+				Value: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(val)},
+			}
+		}
+
+		v.file.Decls = append(v.file.Decls, &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{
+				&ast.ValueSpec{
+					Names: []*ast.Ident{&ast.Ident{Name: siteVarName}},
+					Values: []ast.Expr{&ast.UnaryExpr{
+						Op: token.AND,
+						X: &ast.CompositeLit{
+							Type: &ast.SelectorExpr{
+								X:   &ast.Ident{Name: RuntimePackage},
+								Sel: &ast.Ident{Name: "Site"},
+							},
+							Elts: []ast.Expr{
+								field("Expr", expr),
+								field("Pos", fmt.Sprintf("%s:%d",
+									filepath.Base(position.Filename), position.Line)),
+								field("Decl", decl),
+							},
+						},
+					}},
+				},
+			},
+		})
+	}
+
+	return &ast.Ident{Name: siteVarName}
+}
+
+// SiteFileName returns a file name that's usable in an identifier,
+// ex: "sub_workers" for "/path/to/sub-workers.go".
+func SiteFileName(fileName string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, strings.TrimSuffix(filepath.Base(fileName), ".go"))
+}
+
+// ExprVar returns the var or struct field that an expression refers
+// to, ex: the field of "msg.ReplyCh", or nil.
+func ExprVar(info *types.Info, expr ast.Expr) *types.Var {
+	var obj types.Object
+
+	switch x := expr.(type) {
+	case *ast.Ident:
+		obj = info.Uses[x]
+		if obj == nil {
+			obj = info.Defs[x] // Ex: the "x" of "x := ...".
+		}
+	case *ast.SelectorExpr:
+		obj = info.Uses[x.Sel]
+	case *ast.ParenExpr:
+		return ExprVar(info, x.X)
+	}
+
+	rv, _ := obj.(*types.Var)
+	return rv
+}
+
+// ValueAssertExpr returns an expr that asserts the interface{} result
+// of a runtime call back into the type t, ex: "call.(foo)".  As a
+// type assertion panics on a nil interface value, an interface type
+// t instead uses a comma-ok assertion, ex:
+//
+//   func() foo { v, _ := call.(foo); return v }()
+func (v *Converter) ValueAssertExpr(call ast.Expr, t types.Type) ast.Expr {
+	typeName := types.TypeString(v.pkg, t)
+
+	if !types.IsInterface(t) {
+		return &ast.TypeAssertExpr{X: call, Type: &ast.Ident{Name: typeName}}
+	}
+
+	valueName := RuntimePackage + "Value"
+
+	return &ast.CallExpr{
+		Fun: &ast.FuncLit{
+			Type: &ast.FuncType{
+				Params: &ast.FieldList{},
+				Results: &ast.FieldList{List: []*ast.Field{
+					&ast.Field{Type: &ast.Ident{Name: typeName}},
+				}},
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs: []ast.Expr{
+						&ast.Ident{Name: valueName},
+						&ast.Ident{Name: "_"},
+					},
+					Tok: token.DEFINE,
+					Rhs: []ast.Expr{
+						&ast.TypeAssertExpr{X: call, Type: &ast.Ident{Name: typeName}},
+					},
+				},
+				&ast.ReturnStmt{Results: []ast.Expr{&ast.Ident{Name: valueName}}},
+			}},
+		},
+	}
+}
+
+// SendValueExpr returns an expr that passes the value of a send
+// through the runtime, ex: "gaptureGCtx.OnChanSendValue(msgExpr).(foo)",
+// where elemType is the channel's element type.  Untyped nil values
+// are not passed, and constants or other values whose type is not the
+// element type are first converted to the element type.
+func (v *Converter) SendValueExpr(value ast.Expr, elemType types.Type) ast.Expr {
+	tv, exists := v.info.Types[value]
+	if !exists || tv.Type == nil || tv.IsNil() {
+		return value
+	}
+
+	if tv.Value != nil || !types.Identical(tv.Type, elemType) {
+		value = &ast.CallExpr{
+			Fun: &ast.ParenExpr{
+				X: &ast.Ident{Name: types.TypeString(v.pkg, elemType)},
+			},
+			Args: []ast.Expr{value},
+		}
+	}
+
+	return v.ValueAssertExpr(&ast.CallExpr{
+		Fun:  &ast.Ident{Name: RuntimeVarName + ".OnChanSendValue"},
+		Args: []ast.Expr{value},
+	}, elemType)
+}
+
+// AssignedIdent returns the variable that's assigned the value of an
+// rhs expr by an assignment, or nil if it's not a simple variable.
+func AssignedIdent(assignStmt *ast.AssignStmt, rhs ast.Expr) *ast.Ident {
+	if assignStmt.Tok != token.ASSIGN && assignStmt.Tok != token.DEFINE {
+		return nil
+	}
+
+	for i, expr := range assignStmt.Rhs {
+		if expr == rhs && i < len(assignStmt.Lhs) {
+			ident, ok := assignStmt.Lhs[i].(*ast.Ident)
+			if ok && ident.Name != "_" {
+				return ident
+			}
+		}
+	}
+
+	return nil
+}
+
+// AssignedOkIdent returns the ok variable of a "v, ok := <-ch" (or
+// "v, ok = <-ch") assignment, or nil if there isn't one.
+func AssignedOkIdent(assignStmt *ast.AssignStmt, rhs ast.Expr) *ast.Ident {
+	if assignStmt.Tok != token.ASSIGN && assignStmt.Tok != token.DEFINE {
+		return nil
+	}
+
+	if len(assignStmt.Rhs) == 1 && assignStmt.Rhs[0] == rhs &&
+		len(assignStmt.Lhs) == 2 {
+		ident, ok := assignStmt.Lhs[1].(*ast.Ident)
+		if ok && ident.Name != "_" {
+			return ident
+		}
+	}
+
+	return nil
+}
+
 // MarkModified records that a converter (and its parents) have
 // modified their associated ast.Node(s).
 func (v *Converter) MarkModified() *Converter {
@@ -837,6 +1387,72 @@ func (v *Converter) InsertStmtsAfter(toInsert []ast.Stmt) {
 	blockStmt.List = InsertStmts(blockStmt.List, idx+1, toInsert)
 }
 
+// InsertInitDoneStmts inserts stmt's at the start of every branch of
+// an if or switch stmt, or of the body of a for stmt, whose init is
+// the given stmt, so that they run right after the init, where the
+// vars that the init declares are in scope.  The stmts func is
+// invoked for each branch.  It returns false if the node is not such
+// a stmt.
+func InsertInitDoneStmts(node ast.Node, init ast.Stmt,
+	stmts func() []ast.Stmt) bool {
+	switch x := node.(type) {
+	case *ast.IfStmt:
+		if x.Init != init {
+			return false
+		}
+		x.Body.List = InsertStmts(x.Body.List, 0, stmts())
+		switch e := x.Else.(type) {
+		case nil:
+			x.Else = &ast.BlockStmt{List: stmts()}
+		case *ast.BlockStmt:
+			e.List = InsertStmts(e.List, 0, stmts())
+		default: // An "else if", whose cond might have operations.
+			x.Else = &ast.BlockStmt{List: append(stmts(), e)}
+		}
+		return true
+
+	case *ast.SwitchStmt:
+		if x.Init != init {
+			return false
+		}
+		insertCaseStmts(x.Body, stmts)
+		return true
+
+	case *ast.TypeSwitchStmt:
+		if x.Init != init {
+			return false
+		}
+		insertCaseStmts(x.Body, stmts)
+		return true
+
+	case *ast.ForStmt:
+		if x.Init != init {
+			return false
+		}
+		x.Body.List = InsertStmts(x.Body.List, 0, stmts())
+		return true
+	}
+
+	return false
+}
+
+// insertCaseStmts inserts stmt's at the start of every case clause of
+// a switch stmt's body, adding a default clause if there is none.
+func insertCaseStmts(body *ast.BlockStmt, stmts func() []ast.Stmt) {
+	hasDefault := false
+	for _, stmt := range body.List {
+		if caseClause, ok := stmt.(*ast.CaseClause); ok {
+			caseClause.Body = InsertStmts(caseClause.Body, 0, stmts())
+			if caseClause.List == nil {
+				hasDefault = true
+			}
+		}
+	}
+	if !hasDefault {
+		body.List = append(body.List, &ast.CaseClause{Body: stmts()})
+	}
+}
+
 // InsertStmts inserts the given stmt's into a given position in a
 // stmt list/array.
 func InsertStmts(list []ast.Stmt, pos int, toInsert []ast.Stmt) []ast.Stmt {
@@ -847,6 +1463,22 @@ func InsertStmts(list []ast.Stmt, pos int, toInsert []ast.Stmt) []ast.Stmt {
 	return rv
 }
 
+// HasStmtsPrefix returns true if a stmt list starts with expr stmt's
+// that are the same as the given ones.
+func HasStmtsPrefix(list, prefix []ast.Stmt) bool {
+	if len(list) < len(prefix) {
+		return false
+	}
+	for i, stmt := range prefix {
+		x, ok := stmt.(*ast.ExprStmt)
+		y, ok2 := list[i].(*ast.ExprStmt)
+		if !ok || !ok2 || types.ExprString(x.X) != types.ExprString(y.X) {
+			return false
+		}
+	}
+	return true
+}
+
 // KillPos recursively zero'es out Pos fields from an ast Node tree.
 func KillPos(x ast.Node) {
     killPos(map[interface{}]bool{}, reflect.ValueOf(x))
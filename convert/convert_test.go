@@ -0,0 +1,209 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// testSource is the file around a test's func body.
+var testSource = `package main
+
+import "sync"
+
+func f(ch chan int, mu *sync.Mutex, wg *sync.WaitGroup) {
+%s
+}
+`
+
+// testImporter is shared by the tests, so that it type checks the
+// imported packages from source only once.
+var testImporter = importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+// convertSource instruments the source the way ProcessProgram() does
+// each file, and returns the formatted result.
+func convertSource(t *testing.T, src string) string {
+	fset := token.NewFileSet()
+
+	file, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("ParseFile, err: %v", err)
+	}
+
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+		Implicits:  map[ast.Node]types.Object{},
+		Scopes:     map[ast.Node]*types.Scope{},
+	}
+
+	config := types.Config{Importer: testImporter}
+
+	pkg, err := config.Check("main", fset, []*ast.File{file}, info)
+	if err != nil {
+		t.Fatalf("Check, err: %v", err)
+	}
+
+	ast.Walk(&Converter{
+		info:  info,
+		pkg:   pkg,
+		fset:  fset,
+		file:  file,
+		logf:  func(fmt string, v ...interface{}) {},
+		node:  file,
+		sites: map[string]bool{},
+	}, file)
+
+	var buf bytes.Buffer
+	if err = format.Node(&buf, fset, file); err != nil {
+		t.Fatalf("format.Node, err: %v", err)
+	}
+
+	return buf.String()
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+
+		// expected are in the order that they must appear.
+		expected []string
+
+		// once must appear exactly once.
+		once []string
+	}{
+		{"send", `ch <- 1`, []string{
+			"\tvar gaptureGCtx gapture.GCtx\n",
+			"gaptureGCtx.OnChanSend(gaptureSite_main_6_1, ch).(chan int) <- " +
+				"gaptureGCtx.OnChanSendValue((int)(1)).(int)\n",
+			"\tgaptureGCtx.OnChanSendDone()\n",
+		}, nil},
+
+		{"make", `c := make(chan int, 1); _ = c`, []string{
+			"c := gapture.OnMakeChan(gaptureMakeSite_main_6_6, make(chan int, 1)).(chan int)\n",
+			`var gaptureMakeSite_main_6_6 = &gapture.Site{Expr: "c", Pos: "main.go:6", Decl: "main.go:6"}`,
+		}, nil},
+
+		{"recv value", `x := <-ch; _ = x`, []string{
+			"x := <-gaptureGCtx.OnChanRecv(gaptureSite_main_6_8, ch).(chan int)\n",
+			"\tgaptureGCtx.OnChanRecvDone(x)\n",
+		}, nil},
+
+		{"recv discarded", `<-ch`, []string{
+			"gaptureGCtx.OnChanRecvDone(<-gaptureGCtx.OnChanRecv(gaptureSite_main_6_3, ch).(chan int))\n",
+		}, nil},
+
+		{"recv ok", `x, ok := <-ch; _, _ = x, ok`, []string{
+			"x, ok := <-gaptureGCtx.OnChanRecv(",
+			"\tgaptureGCtx.OnChanRecvOkDone(x, ok)\n",
+		}, nil},
+
+		{"if init recv ok", `if x, ok := <-ch; ok { _ = x }`, []string{
+			"if x, ok := <-gaptureGCtx.OnChanRecv(",
+			"ok {\n\t\tgaptureGCtx.OnChanRecvOkDone(x, ok)\n\t\t_ = x\n",
+			"} else {\n\t\tgaptureGCtx.OnChanRecvOkDone(x, ok)\n\t}\n",
+		}, nil},
+
+		{"switch init recv", `switch x := <-ch; x { case 1: }`, []string{
+			"case 1:\n\t\tgaptureGCtx.OnChanRecvDone(x)\n",
+			"default:\n\t\tgaptureGCtx.OnChanRecvDone(x)\n",
+		}, nil},
+
+		{"for init and post recv", `for x, ok := <-ch; ok; x, ok = <-ch { _ = x }`, []string{
+			"for x, ok := <-gaptureGCtx.OnChanRecv(gaptureSite_main_6_16, ch).(chan int); ok; " +
+				"x, ok = <-gaptureGCtx.OnChanRecv(gaptureSite_main_6_34, ch).(chan int) {\n" +
+				"\t\tgaptureGCtx.OnChanRecvOkDone(x, ok)\n\t\t_ = x\n\t}\n" +
+				"\tgaptureGCtx.OnChanRecvDone(nil)\n}\n",
+		}, []string{
+			"gaptureGCtx.OnChanRecvOkDone(x, ok)",
+			"gaptureGCtx.OnChanRecvDone(nil)",
+		}},
+
+		{"for post recv", `var x int; ok := true; for ; ok; x, ok = <-ch { _ = x }`, []string{
+			"; ok; x, ok = <-gaptureGCtx.OnChanRecv(gaptureSite_main_6_44, ch).(chan int) {\n" +
+				"\t\tgaptureGCtx.OnChanRecvOkDone(x, ok)\n\t\t_ = x\n\t}\n" +
+				"\tgaptureGCtx.OnChanRecvDone(nil)\n}\n",
+		}, []string{
+			"gaptureGCtx.OnChanRecvOkDone(x, ok)",
+		}},
+
+		{"range", `for x := range ch { _ = x }`, []string{
+			"for x := range gaptureGCtx.OnChanRange(gaptureSite_main_6_16, ch).(chan int) {\n",
+			" := gaptureGCtx.OnChanRangeBody(x)\n",
+			"\tgaptureGCtx.OnChanRangeDone()\n",
+		}, nil},
+
+		{"select", "select {\ncase x := <-ch: _ = x\ncase ch <- 2:\n}", []string{
+			"case x := <-gaptureGCtx.OnChanSelectRecv(gaptureSite_main_7_13, 0, ch).(chan int):\n" +
+				"\t\tgaptureGCtx.OnChanSelectRecvValueDone(0, x)\n",
+			"case gaptureGCtx.OnChanSelectSend(gaptureSite_main_8_6, 1, ch).(chan int) <- " +
+				"gaptureGCtx.OnChanSendValue((int)(2)).(int):\n" +
+				"\t\tgaptureGCtx.OnChanSelectSendDone(1)\n",
+		}, nil},
+
+		{"go", `go f(ch, mu, wg)`, []string{
+			"go gaptureGCtx.OnGo(f).(func(ch chan int, mu *sync.Mutex, wg *sync.WaitGroup))(ch, mu, wg)\n",
+		}, nil},
+
+		{"mutex", `mu.Lock(); defer mu.Unlock()`, []string{
+			"\tgaptureGCtx.OnMuLock(gaptureSite_main_6_1, mu)\n",
+			"\tdefer gaptureGCtx.OnMuUnlock(gaptureSite_main_6_18, mu)\n",
+		}, nil},
+
+		{"waitgroup", `wg.Add(2); wg.Done(); wg.Wait()`, []string{
+			"\tgaptureGCtx.OnWGAdd(gaptureSite_main_6_1, wg, 2)\n",
+			"\tgaptureGCtx.OnWGDone(gaptureSite_main_6_12, wg)\n",
+			"\tgaptureGCtx.OnWGWait(gaptureSite_main_6_23, wg)\n",
+		}, nil},
+	}
+
+	for _, test := range tests {
+		out := convertSource(t, fmt.Sprintf(testSource, test.body))
+
+		rest := out
+		for _, expected := range test.expected {
+			i := strings.Index(rest, expected)
+			if i < 0 {
+				t.Errorf("%s, expected: %q, got:\n%s", test.name, expected, out)
+				break
+			}
+			rest = rest[i+len(expected):]
+		}
+
+		for _, once := range test.once {
+			if n := strings.Count(out, once); n != 1 {
+				t.Errorf("%s, %q, got: %d times, expected: once, in:\n%s",
+					test.name, once, n, out)
+			}
+		}
+	}
+}
+
+func TestConvertNoChannels(t *testing.T) {
+	out := convertSource(t, fmt.Sprintf(testSource, `x := 1; _ = x`))
+
+	if strings.Contains(out, "gapture") {
+		t.Errorf("expected no instrumentation, got:\n%s", out)
+	}
+}
@@ -0,0 +1,476 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Waiter is a goroutine that's blocked on channel, lock or
+// WaitGroup operations, as a node in the wait-for graph.
+type Waiter struct {
+	GID     GID
+	Name    string        // See GoroutineName().
+	OpCtxs  []OpCtx       // The pending ops; more than one for a select.
+	Blocked time.Duration // How long the oldest pending op has waited.
+
+	// WaitsFor are the live goroutines that might unblock this
+	// waiter, because they received from a channel this waiter sends
+	// to, or sent to a channel it receives from, or hold a lock that
+	// it waits for, or owe a Done() to a WaitGroup that it waits for.
+	WaitsFor []GID
+}
+
+// DeadlockReport is a diagnosis of goroutines that are stuck on each
+// other, even though other goroutines might still be running.
+type DeadlockReport struct {
+	// Stuck are the waiters that cannot be unblocked by any running
+	// goroutine, directly or transitively.
+	Stuck map[GID]*Waiter
+
+	// Cycles are groups of stuck goroutines that wait for each other.
+	Cycles [][]GID
+
+	// Orphans are stuck goroutines that wait on channels which no
+	// live goroutine has ever used from the other side, or on
+	// WaitGroups which no live goroutine owes a Done().
+	Orphans []GID
+}
+
+// FindDeadlocks builds a wait-for graph from the pending operations
+// of every GCtx and the recent senders and receivers of each channel,
+// and returns a report of the partially deadlocked goroutines, or nil
+// if there are none.  Operations pending for less than minBlocked are
+// ignored, as they're likely just about to complete.
+//
+// FindDeadlocks uses runtime.Stack() of all goroutines to learn which
+// goroutines are alive and blocked, which briefly stops the world.
+func FindDeadlocks(minBlocked time.Duration) *DeadlockReport {
+	states := goroutineStates()
+
+	live := map[GID]bool{}
+	for gid := range states {
+		live[gid] = true
+	}
+
+	now := DefaultRecorder.Now()
+
+	waiters := map[GID]*Waiter{}
+
+	// As in findStalls(), the pending operations of goroutines that
+	// have exited are forgotten, and those of goroutines that are not
+	// blocked in an operation, ex: after a recovered panic, are
+	// skipped, so those goroutines can progress.
+	for _, p := range pending.all() {
+		state, alive := states[p.GID]
+		if !alive {
+			pending.del(p.GCtx)
+			continue
+		}
+		if !opBlockedState(state) {
+			continue
+		}
+
+		for _, opCtx := range p.OpCtxs {
+			blocked := time.Duration(now - opCtx.Begin)
+			if blocked < minBlocked {
+				continue
+			}
+
+			w := waiters[p.GID]
+			if w == nil {
+				w = &Waiter{GID: p.GID, Name: GoroutineName(p.GID)}
+				waiters[p.GID] = w
+			}
+			w.OpCtxs = append(w.OpCtxs, opCtx)
+			if w.Blocked < blocked {
+				w.Blocked = blocked
+			}
+		}
+	}
+
+	for gid, w := range waiters {
+		if !waiterBlocked(w) {
+			delete(waiters, gid)
+			continue
+		}
+
+		var all bool
+		w.WaitsFor, all = waitsFor(w, live)
+		if !all {
+			// A goroutine that the registry forgot or never saw
+			// might still unblock the waiter.
+			delete(waiters, gid)
+		}
+	}
+
+	// A goroutine can progress if it's alive and not a waiter, or if
+	// it's a waiter that waits for a goroutine that can progress.
+	progress := map[GID]bool{}
+	for gid := range live {
+		if waiters[gid] == nil {
+			progress[gid] = true
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for gid, w := range waiters {
+			if progress[gid] {
+				continue
+			}
+			for _, other := range w.WaitsFor {
+				if progress[other] {
+					progress[gid] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	stuck := map[GID]*Waiter{}
+	for gid, w := range waiters {
+		if !progress[gid] {
+			stuck[gid] = w
+		}
+	}
+
+	if len(stuck) <= 0 {
+		return nil
+	}
+
+	rv := &DeadlockReport{Stuck: stuck, Cycles: findCycles(stuck)}
+
+	for gid, w := range stuck {
+		if len(w.WaitsFor) <= 0 {
+			rv.Orphans = append(rv.Orphans, gid)
+		}
+	}
+	sortGIDs(rv.Orphans)
+
+	return rv
+}
+
+// waiterBlocked returns false if any of the waiter's operations can
+// never block, such as a receive from a closed channel, or might be
+// blocked by uninstrumented code, such as a lock whose holder is not
+// known, or a WaitGroup whose adders are not known.
+func waiterBlocked(w *Waiter) bool {
+	for _, opCtx := range w.OpCtxs {
+		if opCtx.Op == OP_CH_CLOSE {
+			return false
+		}
+		if IsLockOp(opCtx.Op) && len(lockHolders(opCtx)) <= 0 {
+			return false
+		}
+		if opCtx.Op == OP_WG_WAIT && len(waitGroupAdders(opCtx)) <= 0 {
+			return false
+		}
+		if IsRecvOp(opCtx.Op) {
+			info, ok := DefaultChanRegistry.Lookup(opCtx.Target)
+			if ok && info.Closed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// waitsFor returns the live goroutines, other than the waiter, that
+// used the waiter's channels from the other side, or that hold its
+// locks or owe a Done() to its WaitGroups.  It also returns false if
+// some goroutine that used one of the channels is not known, see
+// ChanRegistry.TouchersAll().
+func waitsFor(w *Waiter, live map[GID]bool) ([]GID, bool) {
+	seen := map[GID]bool{}
+	all := true
+
+	for _, opCtx := range w.OpCtxs {
+		var others []Toucher
+		if IsSendOp(opCtx.Op) || IsRecvOp(opCtx.Op) {
+			senders, receivers, known := DefaultChanRegistry.TouchersAll(opCtx.Target)
+			if IsSendOp(opCtx.Op) {
+				others = receivers
+			} else {
+				others = senders
+			}
+			all = all && known
+		} else if IsLockOp(opCtx.Op) {
+			for _, gid := range lockHolders(opCtx) {
+				others = append(others, Toucher{GID: gid})
+			}
+		} else if opCtx.Op == OP_WG_WAIT {
+			for _, a := range waitGroupAdders(opCtx) {
+				others = append(others, Toucher{GID: a.GID})
+			}
+		}
+
+		for _, t := range others {
+			if t.GID != w.GID && live[t.GID] {
+				seen[t.GID] = true
+			}
+		}
+	}
+
+	var rv []GID
+	for gid := range seen {
+		rv = append(rv, gid)
+	}
+	sortGIDs(rv)
+
+	return rv, all
+}
+
+// lockHolders returns the goroutines that hold the mutex of a lock
+// operation, which are the (write) lock's holder, and also the read
+// locks' holders for a write lock of an RWMutex.
+func lockHolders(opCtx OpCtx) []GID {
+	info, ok := DefaultChanRegistry.Lookup(opCtx.Target)
+	if !ok {
+		return nil
+	}
+
+	var rv []GID
+	if info.Holder != 0 {
+		rv = append(rv, info.Holder)
+	}
+	if opCtx.Op == OP_RW_LOCK {
+		rv = append(rv, info.Readers...)
+	}
+	return rv
+}
+
+// findCycles returns the strongly connected components of the stuck
+// wait-for graph that have more than one goroutine, using Tarjan's
+// algorithm.
+func findCycles(stuck map[GID]*Waiter) [][]GID {
+	var rv [][]GID
+
+	index := map[GID]int{}
+	lowlink := map[GID]int{}
+	onStack := map[GID]bool{}
+	var stack []GID
+
+	var strongConnect func(gid GID)
+	strongConnect = func(gid GID) {
+		index[gid] = len(index)
+		lowlink[gid] = index[gid]
+		stack = append(stack, gid)
+		onStack[gid] = true
+
+		for _, other := range stuck[gid].WaitsFor {
+			if stuck[other] == nil {
+				continue
+			}
+			if _, visited := index[other]; !visited {
+				strongConnect(other)
+				if lowlink[other] < lowlink[gid] {
+					lowlink[gid] = lowlink[other]
+				}
+			} else if onStack[other] && index[other] < lowlink[gid] {
+				lowlink[gid] = index[other]
+			}
+		}
+
+		if lowlink[gid] == index[gid] {
+			var component []GID
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == gid {
+					break
+				}
+			}
+			if len(component) > 1 {
+				sortGIDs(component)
+				rv = append(rv, component)
+			}
+		}
+	}
+
+	var gids []GID
+	for gid := range stuck {
+		gids = append(gids, gid)
+	}
+	sortGIDs(gids)
+
+	for _, gid := range gids {
+		if _, visited := index[gid]; !visited {
+			strongConnect(gid)
+		}
+	}
+
+	return rv
+}
+
+// String returns a human readable diagnosis, including stacks.
+func (r *DeadlockReport) String() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "partial deadlock: %d goroutine(s) stuck\n", len(r.Stuck))
+
+	described := map[GID]bool{}
+
+	describe := func(gid GID) {
+		w := r.Stuck[gid]
+		described[gid] = true
+		for _, opCtx := range w.OpCtxs {
+			fmt.Fprintf(&b, "  %s blocked for %v on %s of %s%s\n",
+				w.Name, w.Blocked, OpStrings[opCtx.Op], ChanName(opCtx.ChanID),
+				waitGroupDetail(opCtx))
+		}
+		if len(w.WaitsFor) > 0 {
+			fmt.Fprintf(&b, "    waits for %s\n",
+				strings.Join(GoroutineNames(w.WaitsFor), ", "))
+		}
+		if len(w.OpCtxs) > 0 {
+			b.WriteString(indentLines(w.OpCtxs[0].Stack.Text(), "    "))
+		}
+	}
+
+	for _, cycle := range r.Cycles {
+		fmt.Fprintf(&b, "cycle of goroutines %s:\n",
+			strings.Join(GoroutineNames(cycle), ", "))
+		for _, gid := range cycle {
+			describe(gid)
+		}
+	}
+
+	for _, gid := range r.Orphans {
+		if w := r.Stuck[gid]; len(w.OpCtxs) > 0 && w.OpCtxs[0].Op == OP_WG_WAIT {
+			fmt.Fprintf(&b, "orphaned wait, no live goroutine owes a"+
+				" Done() to the WaitGroup:\n")
+		} else {
+			fmt.Fprintf(&b, "orphaned wait, no live goroutine ever used"+
+				" the other side of the channel:\n")
+		}
+		describe(gid)
+	}
+
+	var rest []GID
+	for gid := range r.Stuck {
+		if !described[gid] {
+			rest = append(rest, gid)
+		}
+	}
+	sortGIDs(rest)
+
+	if len(rest) > 0 {
+		fmt.Fprintf(&b, "stuck behind the above:\n")
+		for _, gid := range rest {
+			describe(gid)
+		}
+	}
+
+	return b.String()
+}
+
+// ---------------------------------------------------------------
+
+// LiveGIDs returns the ids of every goroutine that's currently
+// alive, by parsing the output of runtime.Stack() of all goroutines.
+func LiveGIDs() map[GID]bool {
+	rv := map[GID]bool{}
+	for gid := range goroutineStates() {
+		rv[gid] = true
+	}
+	return rv
+}
+
+// goroutineStates returns the status of every goroutine that's
+// currently alive, ex: "chan receive", "sync.Mutex.Lock" or
+// "running", by parsing the output of runtime.Stack() of all
+// goroutines.
+func goroutineStates() map[GID]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	rv := map[GID]string{}
+
+	for len(buf) > 0 {
+		if bytes.HasPrefix(buf, ExpectedStackPrefix) {
+			rest := buf[ExpectedStackPrefixLen:]
+			end := bytes.IndexByte(rest, ' ')
+			if end > 0 {
+				gid, err := strconv.ParseInt(string(rest[:end]), 10, 64)
+				if err == nil {
+					rv[GID(gid)] = goroutineState(rest[end:])
+				}
+			}
+		}
+
+		next := bytes.IndexByte(buf, '\n')
+		if next < 0 {
+			break
+		}
+		buf = buf[next+1:]
+	}
+
+	return rv
+}
+
+// goroutineState parses the status from the rest of a goroutine's
+// header line, ex: " [chan send, 2 minutes]:".
+func goroutineState(rest []byte) string {
+	if eol := bytes.IndexByte(rest, '\n'); eol >= 0 {
+		rest = rest[:eol]
+	}
+	begin := bytes.IndexByte(rest, '[')
+	if begin < 0 {
+		return ""
+	}
+	rest = rest[begin+1:]
+	if end := bytes.IndexAny(rest, ",]"); end >= 0 {
+		rest = rest[:end]
+	}
+	return string(rest)
+}
+
+// opBlockedState returns true if a goroutine status is one in which
+// a channel, lock or WaitGroup operation can be blocked.
+func opBlockedState(state string) bool {
+	return strings.HasPrefix(state, "chan ") ||
+		strings.HasPrefix(state, "select") ||
+		strings.HasPrefix(state, "sync.") ||
+		strings.HasPrefix(state, "semacquire")
+}
+
+func sortGIDs(gids []GID) {
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+}
+
+func indentLines(s, indent string) string {
+	var b bytes.Buffer
+	for _, line := range bytes.SplitAfter([]byte(s), []byte("\n")) {
+		if len(line) > 0 {
+			b.WriteString(indent)
+			b.Write(line)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,249 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKeepAlive holds the channels and WaitGroups of the tests, as
+// the registry knows them by address, so that a later test does not
+// see the entries of an earlier test's garbage collected ones.
+var testKeepAlive []interface{}
+
+// newTestChan returns a channel that's kept alive, which is created
+// by an instrumented make(chan) if made is true.
+func newTestChan(made bool) chan int {
+	ch := make(chan int)
+	if made {
+		OnMakeChan(nil, ch)
+	}
+	testKeepAlive = append(testKeepAlive, ch)
+	return ch
+}
+
+// waitBlocked waits until the goroutines are blocked in a channel,
+// lock or WaitGroup operation.
+func waitBlocked(t *testing.T, gids ...GID) {
+	for i := 0; i < 1000; i++ {
+		states := goroutineStates()
+		n := 0
+		for _, gid := range gids {
+			if opBlockedState(states[gid]) {
+				n++
+			}
+		}
+		if n == len(gids) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("goroutines %v did not block", gids)
+}
+
+// blockRecv starts a goroutine that receives from ch with the hooks,
+// and returns its GID once its receive is pending.
+func blockRecv(ch chan int) GID {
+	gidCh := make(chan GID)
+	go func() {
+		var gctx GCtx
+		gctx.EnsureGID()
+		gctx.OnChanRecv(nil, ch)
+		gidCh <- gctx.GID
+		gctx.OnChanRecvDone(<-ch)
+	}()
+	return <-gidCh
+}
+
+func findStuck(gid GID) *Waiter {
+	r := FindDeadlocks(0)
+	if r == nil {
+		return nil
+	}
+	return r.Stuck[gid]
+}
+
+func isOrphan(gid GID) bool {
+	r := FindDeadlocks(0)
+	if r == nil {
+		return false
+	}
+	for _, orphan := range r.Orphans {
+		if orphan == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFindDeadlocksCycle(t *testing.T) {
+	ch1 := newTestChan(true)
+	ch2 := newTestChan(true)
+
+	a := blockRecv(ch1)
+	b := blockRecv(ch2)
+	defer close(ch1)
+	defer close(ch2)
+
+	// Each goroutine sent to the channel that the other receives from.
+	now := DefaultRecorder.Now()
+	DefaultChanRegistry.Touch(ch1, b, OP_CH_SEND, now)
+	DefaultChanRegistry.Touch(ch2, a, OP_CH_SEND, now)
+
+	waitBlocked(t, a, b)
+
+	r := FindDeadlocks(0)
+	if r == nil {
+		t.Fatalf("expected a report")
+	}
+	expected := []GID{a, b}
+	if a > b {
+		expected = []GID{b, a}
+	}
+	if len(r.Cycles) != 1 || !reflect.DeepEqual(r.Cycles[0], expected) {
+		t.Errorf("cycles, got: %v, expected: [%v]", r.Cycles, expected)
+	}
+	if !reflect.DeepEqual(r.Stuck[a].WaitsFor, []GID{b}) {
+		t.Errorf("waits for, got: %v, expected: [%d]", r.Stuck[a].WaitsFor, b)
+	}
+	if isOrphan(a) || isOrphan(b) {
+		t.Errorf("expected no orphans, got: %v", r.Orphans)
+	}
+}
+
+func TestFindDeadlocksOrphan(t *testing.T) {
+	made := newTestChan(true)
+	unmade := newTestChan(false)
+	forgot := newTestChan(true)
+
+	// Senders that have exited, more than the registry remembers.
+	for i := 0; i <= DefaultChanTouchers; i++ {
+		DefaultChanRegistry.Touch(forgot, GID(-1-i), OP_CH_SEND, 0)
+	}
+
+	tests := []struct {
+		name   string
+		ch     chan int
+		orphan bool
+	}{
+		{"made", made, true},
+		{"not made", unmade, false},
+		{"forgot senders", forgot, false},
+	}
+
+	for _, test := range tests {
+		gid := blockRecv(test.ch)
+		waitBlocked(t, gid)
+
+		if got := isOrphan(gid); got != test.orphan {
+			t.Errorf("%s, orphan, got: %v, expected: %v", test.name, got, test.orphan)
+		}
+		if got := findStuck(gid) != nil; got != test.orphan {
+			t.Errorf("%s, stuck, got: %v, expected: %v", test.name, got, test.orphan)
+		}
+
+		close(test.ch)
+	}
+}
+
+func TestFindDeadlocksRecoveredPanic(t *testing.T) {
+	ch := newTestChan(true)
+	close(ch) // Not instrumented, so the registry doesn't know.
+
+	var stop int32
+	gidCh := make(chan GID)
+	go func() {
+		var gctx GCtx
+		gctx.EnsureGID()
+		func() {
+			defer func() { recover() }()
+			gctx.OnChanSend(nil, ch)
+			ch <- 1
+			gctx.OnChanSendDone()
+		}()
+		gidCh <- gctx.GID
+
+		// Still alive, but not blocked in an operation.
+		for atomic.LoadInt32(&stop) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	gid := <-gidCh
+	defer atomic.StoreInt32(&stop, 1)
+
+	found := false
+	for _, p := range pending.all() {
+		found = found || p.GID == gid
+	}
+	if !found {
+		t.Fatalf("expected the send to be left pending")
+	}
+
+	if w := findStuck(gid); w != nil {
+		t.Errorf("expected not stuck, got: %+v", w)
+	}
+}
+
+func TestFindCycles(t *testing.T) {
+	tests := []struct {
+		waitsFor map[GID][]GID
+		expected [][]GID
+	}{
+		{map[GID][]GID{1: nil}, nil},
+		{map[GID][]GID{1: {1}}, nil},
+		{map[GID][]GID{1: {2}, 2: {1}}, [][]GID{{1, 2}}},
+		{map[GID][]GID{1: {2}, 2: {3}, 3: {1}, 4: {1}}, [][]GID{{1, 2, 3}}},
+		{map[GID][]GID{1: {2}, 2: {1}, 3: {4}, 4: {3, 5}}, [][]GID{{1, 2}, {3, 4}}},
+		{map[GID][]GID{1: {2}, 2: {3}, 3: nil}, nil},
+	}
+
+	for i, test := range tests {
+		stuck := map[GID]*Waiter{}
+		for gid, waitsFor := range test.waitsFor {
+			stuck[gid] = &Waiter{GID: gid, WaitsFor: waitsFor}
+		}
+
+		got := findCycles(stuck)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test %d, got: %v, expected: %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestGoroutineState(t *testing.T) {
+	tests := []struct {
+		header  string
+		state   string
+		blocked bool
+	}{
+		{" [chan send, 2 minutes]:\n", "chan send", true},
+		{" [select]:\n", "select", true},
+		{" [sync.Mutex.Lock]:\n", "sync.Mutex.Lock", true},
+		{" [semacquire]:\n", "semacquire", true},
+		{" [running]:\n", "running", false},
+		{" [sleep]:\n", "sleep", false},
+		{" no state\n", "", false},
+	}
+
+	for _, test := range tests {
+		state := goroutineState([]byte(test.header))
+		if state != test.state {
+			t.Errorf("%q, got: %q, expected: %q", test.header, state, test.state)
+		}
+		if opBlockedState(state) != test.blocked {
+			t.Errorf("%q, blocked, expected: %v", test.header, test.blocked)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// chromeEvent is an event of the Trace Event Format, see...
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type chromeEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	TS   float64                `json:"ts"` // Microseconds.
+	Dur  *float64               `json:"dur,omitempty"`
+	PID  int                    `json:"pid"`
+	TID  int64                  `json:"tid"`
+	ID   int64                  `json:"id,omitempty"`
+	BP   string                 `json:"bp,omitempty"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// Chrome writes the events of a trace as Trace Event Format JSON,
+// which can be opened by chrome://tracing or ui.perfetto.dev.  Each
+// goroutine is a track, each channel operation is a duration slice,
+// and each send is linked to its matching receive by a flow arrow.
+// Each mutex operation is a slice too, with the holder of the lock
+// that a lock operation waited for, and so is each WaitGroup
+// operation, with the WaitGroup's counter after the operation.
+// The lifetime of a spawned goroutine is also a slice, linked from
+// its parent's go statement by a flow arrow.
+func Chrome(r *trace.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	_, err := bw.WriteString(`{"displayTimeUnit":"ns","traceEvents":[`)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(bw)
+
+	first := true
+
+	emit := func(ce *chromeEvent) error {
+		if !first {
+			if err := bw.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		first = false
+		return enc.Encode(ce)
+	}
+
+	// The tracks are named after the last event, as goroutines might
+	// be named late.
+	var tracks []int64
+
+	seen := map[int64]bool{}
+
+	track := func(gid int64) error {
+		if !seen[gid] {
+			seen[gid] = true
+			tracks = append(tracks, gid)
+		}
+		return nil
+	}
+
+	matcher := NewMatcher()
+
+	var flowID int64
+
+	err = ReadSpans(r, func(s *Span) error {
+		if err := track(s.GID); err != nil {
+			return err
+		}
+
+		dur := float64(s.End-s.Begin) / 1000.0
+
+		if IsGo(s.OpName) {
+			return emitGo(r, s, dur, track, emit, &flowID)
+		}
+
+		args := map[string]interface{}{
+			"site":      r.Stack(s.StackID).Site,
+			"completed": s.Completed,
+		}
+
+		cat := "chan"
+		if IsMutex(s.OpName) {
+			cat = "mutex"
+			args["mutex"] = ChanName(r, s.ChanID)
+			if s.Holder != 0 {
+				args["holder"] = GoroutineName(r, s.Holder)
+			}
+		} else if IsWaitGroup(s.OpName) {
+			cat = "waitgroup"
+			args["waitgroup"] = ChanName(r, s.ChanID)
+			args["counter"] = s.Len
+		} else {
+			args["chan"] = ChanName(r, s.ChanID)
+			args["len"] = s.Len
+			args["cap"] = s.Cap
+		}
+		if s.CaseNum >= 0 {
+			args["case"] = s.CaseNum
+		}
+		if s.Value != "" {
+			args["value"] = s.Value
+		}
+		if s.Closed {
+			args["closed"] = true
+		}
+
+		err := emit(&chromeEvent{
+			Name: s.OpName,
+			Cat:  cat,
+			Ph:   "X",
+			TS:   float64(s.Begin) / 1000.0,
+			Dur:  &dur,
+			PID:  1,
+			TID:  s.GID,
+			Args: args,
+		})
+		if err != nil {
+			return err
+		}
+
+		m := matcher.Add(s)
+		if m == nil {
+			return nil
+		}
+
+		flowID++
+
+		err = emit(&chromeEvent{
+			Name: ChanName(r, m.ChanID),
+			Cat:  "msg",
+			Ph:   "s",
+			TS:   float64(m.Send.End) / 1000.0,
+			PID:  1,
+			TID:  m.Send.GID,
+			ID:   flowID,
+		})
+		if err != nil {
+			return err
+		}
+
+		return emit(&chromeEvent{
+			Name: ChanName(r, m.ChanID),
+			Cat:  "msg",
+			Ph:   "f",
+			BP:   "e",
+			TS:   float64(m.Recv.End) / 1000.0,
+			PID:  1,
+			TID:  m.Recv.GID,
+			ID:   flowID,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, gid := range tracks {
+		err = emit(&chromeEvent{
+			Name: "thread_name", Ph: "M", PID: 1, TID: gid,
+			Args: map[string]interface{}{"name": GoroutineName(r, gid)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = bw.WriteString("]}\n")
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// emitGo emits the lifetime slice of a spawned goroutine, and the
+// flow arrow from its parent.
+func emitGo(r *trace.Reader, s *Span, dur float64,
+	track func(gid int64) error, emit func(ce *chromeEvent) error,
+	flowID *int64) error {
+	g := r.Goroutine(s.GID)
+	if g == nil {
+		g = &trace.Goroutine{GID: s.GID, StackID: s.StackID}
+	}
+
+	name := g.Func
+	if name == "" {
+		name = s.OpName
+	}
+
+	args := map[string]interface{}{
+		"parent":    GoroutineName(r, g.Parent),
+		"site":      r.Stack(s.StackID).Site,
+		"completed": s.Completed,
+	}
+	if s.Panicked {
+		args["panicked"] = true
+	}
+
+	err := emit(&chromeEvent{
+		Name: name,
+		Cat:  "go",
+		Ph:   "X",
+		TS:   float64(s.Begin) / 1000.0,
+		Dur:  &dur,
+		PID:  1,
+		TID:  s.GID,
+		Args: args,
+	})
+	if err != nil || g.Parent == 0 {
+		return err
+	}
+
+	err = track(g.Parent)
+	if err != nil {
+		return err
+	}
+
+	*flowID++
+
+	err = emit(&chromeEvent{
+		Name: "go",
+		Cat:  "go",
+		Ph:   "s",
+		TS:   float64(s.Begin) / 1000.0,
+		PID:  1,
+		TID:  g.Parent,
+		ID:   *flowID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return emit(&chromeEvent{
+		Name: "go",
+		Cat:  "go",
+		Ph:   "f",
+		BP:   "e",
+		TS:   float64(s.Begin) / 1000.0,
+		PID:  1,
+		TID:  s.GID,
+		ID:   *flowID,
+	})
+}
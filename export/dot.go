@@ -0,0 +1,246 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+type dotEdgeKey struct {
+	gid    int64
+	chanID int64
+	kind   string // "send", "recv", "close", "closed" (a closed recv), "lock", "rlock", "add", "done" or "wait".
+}
+
+type dotEdge struct {
+	count   int           // Completed operations.
+	blocked time.Duration // Total time from begin to end.
+}
+
+// Dot writes the goroutine / channel communication topology of a
+// trace as a Graphviz DOT graph.  Goroutines and channels are nodes,
+// where goroutines are grouped into clusters by the function that
+// the goroutine started with.  Edges are weighted by the counts of
+// sends, receives and closes and by the total time blocked, and
+// dotted edges from parent to child goroutines show the goroutine
+// tree of spawned goroutines.  Mutexes are nodes too, with edges
+// for the locks that goroutines acquired, weighted by the total time
+// spent waiting for the locks, and so are WaitGroups, with edges for
+// the Add()'s, Done()'s and Wait()'s.
+func Dot(r *trace.Reader, w io.Writer) error {
+	edges := map[dotEdgeKey]*dotEdge{}
+	groups := map[int64]string{} // Keyed by gid.
+	chans := map[int64]bool{}
+
+	panicked := map[int64]bool{}
+
+	err := ReadSpans(r, func(s *Span) error {
+		if IsGo(s.OpName) { // The stack is the parent's go statement.
+			panicked[s.GID] = s.Panicked
+			return nil
+		}
+
+		if groups[s.GID] == "" {
+			groups[s.GID] = RootFunc(r.Stack(s.StackID).Text)
+		}
+
+		if s.ChanID == 0 {
+			return nil
+		}
+
+		kind := ""
+		lock, read := IsLock(s.OpName)
+		switch {
+		case lock && read:
+			kind = "rlock"
+		case lock:
+			kind = "lock"
+		case IsWaitGroup(s.OpName):
+			kind = strings.TrimPrefix(s.OpName, "wg-")
+		case IsSend(s.OpName):
+			kind = "send"
+		case IsRecv(s.OpName) && s.Closed:
+			kind = "closed"
+		case IsRecv(s.OpName):
+			kind = "recv"
+		case s.OpName == "ch-close":
+			kind = "close"
+		default:
+			return nil
+		}
+
+		chans[s.ChanID] = true
+
+		k := dotEdgeKey{s.GID, s.ChanID, kind}
+		e := edges[k]
+		if e == nil {
+			e = &dotEdge{}
+			edges[k] = e
+		}
+		if s.Completed {
+			e.count++
+		}
+		e.blocked += time.Duration(s.End - s.Begin)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Spawned goroutines are grouped by their func, even when they
+	// had no channel operations.
+	var spawned []*trace.Goroutine
+	for _, g := range r.Goroutines {
+		spawned = append(spawned, g)
+		groups[g.GID] = g.Func
+		if _, exists := groups[g.Parent]; !exists {
+			groups[g.Parent] = ""
+		}
+	}
+	sort.Slice(spawned, func(i, j int) bool {
+		return spawned[i].GID < spawned[j].GID
+	})
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "digraph gapture {\n")
+	fmt.Fprintf(bw, "  rankdir=LR;\n")
+	fmt.Fprintf(bw, "  node [fontsize=10];\n")
+	fmt.Fprintf(bw, "  edge [fontsize=9];\n")
+
+	// Goroutines, clustered by their starting function.
+	byGroup := map[string][]int64{}
+	for gid, group := range groups {
+		byGroup[group] = append(byGroup[group], gid)
+	}
+
+	var groupNames []string
+	for group := range byGroup {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+
+	for i, group := range groupNames {
+		gids := byGroup[group]
+		sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(bw, "    label=%s;\n", dotQuote(group))
+		fmt.Fprintf(bw, "    style=rounded;\n")
+		for _, gid := range gids {
+			label := GoroutineName(r, gid)
+			if panicked[gid] {
+				label += "\npanicked"
+			}
+			fmt.Fprintf(bw, "    g%d [label=%s];\n", gid, dotQuote(label))
+		}
+		fmt.Fprintf(bw, "  }\n")
+	}
+
+	// Channels.
+	var chanIDs []int64
+	for chanID := range chans {
+		chanIDs = append(chanIDs, chanID)
+	}
+	sort.Slice(chanIDs, func(i, j int) bool { return chanIDs[i] < chanIDs[j] })
+
+	for _, chanID := range chanIDs {
+		c := r.Chan(chanID)
+		if IsMutexType(c.Type) {
+			fmt.Fprintf(bw, "  ch%d [shape=box, style=filled, fillcolor=lightblue,"+
+				" label=%s];\n", chanID, dotQuote(ChanName(r, chanID)+"\n"+c.Type))
+			continue
+		}
+		if IsWaitGroupType(c.Type) {
+			fmt.Fprintf(bw, "  ch%d [shape=box, style=filled, fillcolor=palegreen,"+
+				" label=%s];\n", chanID, dotQuote(ChanName(r, chanID)+"\n"+c.Type))
+			continue
+		}
+
+		label := fmt.Sprintf("%s\n%s, cap %d", ChanName(r, chanID), c.Type, c.Cap)
+		if c.Site != "" {
+			label += "\n" + c.Site
+		}
+		if c.Creator != 0 {
+			label += "\nmade by " + GoroutineName(r, c.Creator)
+		}
+		fmt.Fprintf(bw, "  ch%d [shape=box, style=filled, fillcolor=lightyellow,"+
+			" label=%s];\n", chanID, dotQuote(label))
+	}
+
+	// Edges, with sends, closes, Add()'s and Done()'s from goroutine
+	// to channel or WaitGroup, and receives, locks and Wait()'s to the
+	// goroutine.
+	var keys []dotEdgeKey
+	for k := range edges {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].gid != keys[j].gid {
+			return keys[i].gid < keys[j].gid
+		}
+		if keys[i].chanID != keys[j].chanID {
+			return keys[i].chanID < keys[j].chanID
+		}
+		return keys[i].kind < keys[j].kind
+	})
+
+	for _, k := range keys {
+		e := edges[k]
+
+		from, to := fmt.Sprintf("g%d", k.gid), fmt.Sprintf("ch%d", k.chanID)
+		if k.kind == "recv" || k.kind == "closed" ||
+			k.kind == "lock" || k.kind == "rlock" || k.kind == "wait" {
+			from, to = to, from
+		}
+
+		attrs := []string{
+			"label=" + dotQuote(fmt.Sprintf("%s %d\nblocked %v",
+				k.kind, e.count, e.blocked)),
+			"weight=" + strconv.Itoa(e.count+1),
+			"penwidth=" + strconv.FormatFloat(
+				1+math.Log10(float64(e.count+1)), 'f', 2, 64),
+		}
+		if k.kind == "close" || k.kind == "closed" || k.kind == "done" {
+			attrs = append(attrs, "style=dashed")
+		}
+
+		fmt.Fprintf(bw, "  %s -> %s [%s];\n", from, to, strings.Join(attrs, ", "))
+	}
+
+	// Spawns, from parent to child goroutine.
+	for _, g := range spawned {
+		fmt.Fprintf(bw, "  g%d -> g%d [label=%s, style=dotted];\n",
+			g.Parent, g.GID, dotQuote("go\n"+r.Stack(g.StackID).Site))
+	}
+
+	fmt.Fprintf(bw, "}\n")
+
+	return bw.Flush()
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
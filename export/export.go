@@ -0,0 +1,263 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package export converts gapture traces into formats that are
+// understood by other tools.
+package export
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// A Span is an operation by a goroutine, from its begin event to its
+// end event.  The lifetime of a spawned goroutine is also a span,
+// with an OpName of "go", from its spawn event to its exit event.
+type Span struct {
+	GID       int64
+	Op        int
+	OpName    string
+	CaseNum   int
+	ChanID    int64
+	Begin     int64 // Timestamp of the begin event.
+	End       int64 // Timestamp of the end event.
+	Len       int   // The channel's len() or WaitGroup's counter at the end event.
+	Cap       int
+	StackID   uint64
+	Completed bool
+	Value     string // The encoded message, if values were captured.
+	Closed    bool   // A receive that returned because of a close.
+	Panicked  bool   // A goroutine that did not return normally.
+	Holder    int64  // The gid that held the mutex when a lock began.
+}
+
+type spanKey struct {
+	gid     int64
+	op      int
+	caseNum int
+	chanID  int64
+}
+
+// ReadSpans reads every event of a trace, pairing begin and end
+// events into spans, and invokes the callback with each span when
+// its end event is read.  Spans whose end event is missing, such as
+// operations that were still blocked when the recording stopped, are
+// passed to the callback after the last event, ending at the last
+// timestamp and with Completed of false.
+func ReadSpans(r *trace.Reader, cb func(s *Span) error) error {
+	begins := map[spanKey][]*trace.Event{}
+
+	var lastTS int64
+
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		lastTS = e.TS
+
+		k := spanKey{e.GID, e.Op, e.CaseNum, e.ChanID}
+
+		if e.Kind == trace.KIND_BEGIN || e.Kind == trace.KIND_SPAWN {
+			ec := *e
+			begins[k] = append(begins[k], &ec)
+			continue
+		}
+
+		s := &Span{
+			GID:       e.GID,
+			Op:        e.Op,
+			OpName:    r.OpName(e.Op),
+			CaseNum:   e.CaseNum,
+			ChanID:    e.ChanID,
+			Begin:     e.TS,
+			End:       e.TS,
+			Len:       e.Len,
+			Cap:       e.Cap,
+			StackID:   e.StackID,
+			Completed: e.Completed,
+			Value:     e.Value,
+			Closed:    e.Closed,
+			Panicked:  e.Panicked,
+		}
+
+		if b := begins[k]; len(b) > 0 { // Innermost begin.
+			s.Begin = b[len(b)-1].TS
+			s.Holder = b[len(b)-1].Holder
+			begins[k] = b[:len(b)-1]
+		}
+
+		err = cb(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	var unended []*trace.Event
+	for _, b := range begins {
+		unended = append(unended, b...)
+	}
+	sort.Slice(unended, func(i, j int) bool {
+		return unended[i].TS < unended[j].TS
+	})
+
+	for _, e := range unended {
+		err := cb(&Span{
+			GID:     e.GID,
+			Op:      e.Op,
+			OpName:  r.OpName(e.Op),
+			CaseNum: e.CaseNum,
+			ChanID:  e.ChanID,
+			Begin:   e.TS,
+			End:     lastTS,
+			Len:     e.Len,
+			Cap:     e.Cap,
+			StackID: e.StackID,
+			Holder:  e.Holder,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsSend returns true if the op name is a send to a channel.
+func IsSend(opName string) bool {
+	return opName == "ch-send" || opName == "ch-select-send"
+}
+
+// IsRecv returns true if the op name is a receive from a channel.
+func IsRecv(opName string) bool {
+	return opName == "ch-recv" || opName == "ch-select-recv" ||
+		opName == "ch-range"
+}
+
+// IsLock returns true if the op name acquires a lock of a mutex,
+// where read is true for a read lock of an RWMutex.
+func IsLock(opName string) (lock, read bool) {
+	switch opName {
+	case "mu-lock", "rw-lock":
+		return true, false
+	case "rw-rlock":
+		return true, true
+	}
+	return false, false
+}
+
+// IsMutex returns true if the op name is a lock or unlock of a mutex.
+func IsMutex(opName string) bool {
+	return strings.HasPrefix(opName, "mu-") || strings.HasPrefix(opName, "rw-")
+}
+
+// IsWaitGroup returns true if the op name is an Add(), Done() or
+// Wait() of a WaitGroup.
+func IsWaitGroup(opName string) bool {
+	return strings.HasPrefix(opName, "wg-")
+}
+
+// IsGo returns true if the op name is the lifetime of a spawned
+// goroutine.
+func IsGo(opName string) bool {
+	return opName == "go"
+}
+
+// GoroutineName returns the display name of a goroutine, which is
+// its name if it was spawned by an instrumented go statement or was
+// named, ex: "main.worker#3".
+func GoroutineName(r *trace.Reader, gid int64) string {
+	if g := r.Goroutine(gid); g != nil && g.Name != "" {
+		return g.Name
+	}
+	return fmt.Sprintf("goroutine %d", gid)
+}
+
+// ChanName returns the display name of a channel, which is its name
+// from gapture.NameChan() or from the instrumented source code if
+// known, ex: "subtasks", followed by its tags, if any, ex:
+// "ingest.requests{shard=3}".
+func ChanName(r *trace.Reader, chanID int64) string {
+	c := r.Chans[chanID]
+
+	name := fmt.Sprintf("ch#%d", chanID)
+	if c != nil && IsMutexType(c.Type) {
+		name = fmt.Sprintf("mu#%d", chanID)
+	} else if c != nil && IsWaitGroupType(c.Type) {
+		name = fmt.Sprintf("wg#%d", chanID)
+	}
+	if c != nil && c.Name != "" {
+		name = c.Name
+	}
+	if c != nil && len(c.Tags) > 0 {
+		name += "{" + ChanTags(c) + "}"
+	}
+	return name
+}
+
+// IsMutexType returns true if the type of a channel record is of a
+// mutex, which is registered along with channels.
+func IsMutexType(typ string) bool {
+	return typ == "sync.Mutex" || typ == "sync.RWMutex"
+}
+
+// IsWaitGroupType returns true if the type of a channel record is of
+// a WaitGroup, which is registered along with channels.
+func IsWaitGroupType(typ string) bool {
+	return typ == "sync.WaitGroup"
+}
+
+// ChanTags returns the tags of a channel ordered by key, ex:
+// "shard=3,zone=b".
+func ChanTags(c *trace.Chan) string {
+	keys := make([]string, 0, len(c.Tags))
+	for k := range c.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+c.Tags[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// RootFunc returns the name of the function that a goroutine started
+// with, which is the outermost frame of a stack in the format of
+// runtime.Stack(), or "" if unknown.
+func RootFunc(stackText string) string {
+	lines := strings.Split(stackText, "\n")
+
+	rv := ""
+	for _, line := range lines {
+		if line == "" ||
+			strings.HasPrefix(line, "\t") ||
+			strings.HasPrefix(line, "created by ") {
+			continue
+		}
+		rv = line
+	}
+
+	if i := strings.LastIndexByte(rv, '('); i > 0 {
+		rv = rv[:i]
+	}
+
+	return rv
+}
@@ -0,0 +1,61 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package export
+
+// A Message is a send matched with the receive of the sent value.
+type Message struct {
+	ChanID int64
+	Send   *Span
+	Recv   *Span
+}
+
+// A Matcher pairs completed sends with completed receives, ignoring
+// receives that returned because the channel was closed.  As
+// channels are FIFO, the n'th completed send on a channel is matched
+// with the n'th completed receive on that channel.  As the end events
+// of different goroutines are recorded independently, the matching is
+// best effort when many goroutines race on the same channel.
+type Matcher struct {
+	sends map[int64][]*Span // Unmatched sends, keyed by ChanID.
+	recvs map[int64][]*Span // Unmatched receives, keyed by ChanID.
+}
+
+func NewMatcher() *Matcher {
+	return &Matcher{
+		sends: map[int64][]*Span{},
+		recvs: map[int64][]*Span{},
+	}
+}
+
+// Add offers a span to the matcher, and returns the Message if the
+// span completed a match, or nil.
+func (m *Matcher) Add(s *Span) *Message {
+	if !s.Completed || s.ChanID == 0 {
+		return nil
+	}
+
+	if IsSend(s.OpName) {
+		if recvs := m.recvs[s.ChanID]; len(recvs) > 0 {
+			m.recvs[s.ChanID] = recvs[1:]
+			return &Message{ChanID: s.ChanID, Send: s, Recv: recvs[0]}
+		}
+		m.sends[s.ChanID] = append(m.sends[s.ChanID], s)
+	} else if IsRecv(s.OpName) && !s.Closed {
+		if sends := m.sends[s.ChanID]; len(sends) > 0 {
+			m.sends[s.ChanID] = sends[1:]
+			return &Message{ChanID: s.ChanID, Send: sends[0], Recv: s}
+		}
+		m.recvs[s.ChanID] = append(m.recvs[s.ChanID], s)
+	}
+
+	return nil
+}
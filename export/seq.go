@@ -0,0 +1,215 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// seqStep is an arrow or a note of a sequence diagram.
+type seqStep struct {
+	from, to int64 // For a note, only from is used.
+	label    string
+	note     bool
+	dashed   bool // From the closer to a receiver that observed the close.
+
+	// The label is completed with the channel's name after the whole
+	// trace is read, as a channel might be named late.
+	chanID int64
+	value  string
+}
+
+// seqDiagram is the goroutines and steps of a sequence diagram, in
+// the order that they happened.
+type seqDiagram struct {
+	gids  []int64
+	steps []seqStep
+}
+
+func readSeqDiagram(r *trace.Reader) (*seqDiagram, error) {
+	d := &seqDiagram{}
+
+	seen := map[int64]bool{}
+	participant := func(gid int64) {
+		if !seen[gid] {
+			seen[gid] = true
+			d.gids = append(d.gids, gid)
+		}
+	}
+
+	matcher := NewMatcher()
+
+	closers := map[int64]int64{} // Keyed by chanID, value is gid.
+
+	// A receive might observe a close before the closer's end event,
+	// so the closers of observed closes are resolved afterwards.
+	observed := map[int]int64{} // Keyed by step index, value is chanID.
+
+	err := ReadSpans(r, func(s *Span) error {
+		if !s.Completed || s.ChanID == 0 {
+			return nil
+		}
+
+		if s.OpName == "ch-close" {
+			participant(s.GID)
+			closers[s.ChanID] = s.GID
+			d.steps = append(d.steps, seqStep{
+				from:   s.GID,
+				label:  "close ",
+				note:   true,
+				chanID: s.ChanID,
+			})
+			return nil
+		}
+
+		if IsRecv(s.OpName) && s.Closed {
+			participant(s.GID)
+			observed[len(d.steps)] = s.ChanID
+			d.steps = append(d.steps, seqStep{
+				from:   s.GID,
+				label:  "observed close of ",
+				note:   true,
+				chanID: s.ChanID,
+			})
+			return nil
+		}
+
+		m := matcher.Add(s)
+		if m != nil {
+			participant(m.Send.GID)
+			participant(m.Recv.GID)
+			d.steps = append(d.steps, seqStep{
+				from:   m.Send.GID,
+				to:     m.Recv.GID,
+				chanID: m.ChanID,
+				value:  messageValue(m),
+			})
+		}
+
+		return nil
+	})
+
+	for i, chanID := range observed {
+		if closer, exists := closers[chanID]; exists {
+			d.steps[i] = seqStep{
+				from:   closer,
+				to:     d.steps[i].from,
+				label:  "closed ",
+				dashed: true,
+				chanID: chanID,
+			}
+		}
+	}
+
+	for i := range d.steps {
+		step := &d.steps[i]
+		step.label += ChanName(r, step.chanID)
+		if step.value != "" {
+			step.label += ": " + step.value
+		}
+	}
+
+	return d, err
+}
+
+// DefaultSeqValueMaxLen is the max length of a message value shown in
+// a sequence diagram's arrow label.
+var DefaultSeqValueMaxLen = 40
+
+// messageValue returns the captured value of a message, preferring
+// what was received, shortened for a label.
+func messageValue(m *Message) string {
+	v := m.Recv.Value
+	if v == "" {
+		v = m.Send.Value
+	}
+	if len(v) > DefaultSeqValueMaxLen {
+		v = v[:DefaultSeqValueMaxLen] + "..."
+	}
+	return v
+}
+
+// Mermaid writes the message passing of a trace as a Mermaid
+// sequence diagram, where each goroutine is a participant, each
+// matched send and receive is an arrow labeled with the channel (and
+// the message, if values were captured), each close is a note, and
+// each receive that observed a close is a dashed arrow from the
+// closer.  It's intended for small recordings.
+func Mermaid(r *trace.Reader, w io.Writer) error {
+	d, err := readSeqDiagram(r)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "sequenceDiagram\n")
+	for _, gid := range d.gids {
+		fmt.Fprintf(bw, "    participant g%d as %s\n",
+			gid, mermaidEscape(GoroutineName(r, gid)))
+	}
+	for _, step := range d.steps {
+		if step.note {
+			fmt.Fprintf(bw, "    Note over g%d: %s\n",
+				step.from, mermaidEscape(step.label))
+		} else if step.dashed {
+			fmt.Fprintf(bw, "    g%d-->>g%d: %s\n",
+				step.from, step.to, mermaidEscape(step.label))
+		} else {
+			fmt.Fprintf(bw, "    g%d->>g%d: %s\n",
+				step.from, step.to, mermaidEscape(step.label))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// PlantUML writes the same sequence diagram as Mermaid(), but in
+// the PlantUML syntax.
+func PlantUML(r *trace.Reader, w io.Writer) error {
+	d, err := readSeqDiagram(r)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "@startuml\n")
+	for _, gid := range d.gids {
+		fmt.Fprintf(bw, "participant %q as g%d\n", GoroutineName(r, gid), gid)
+	}
+	for _, step := range d.steps {
+		label := strings.Replace(step.label, "\n", " ", -1)
+		if step.note {
+			fmt.Fprintf(bw, "note over g%d : %s\n", step.from, label)
+		} else if step.dashed {
+			fmt.Fprintf(bw, "g%d --> g%d : %s\n", step.from, step.to, label)
+		} else {
+			fmt.Fprintf(bw, "g%d -> g%d : %s\n", step.from, step.to, label)
+		}
+	}
+	fmt.Fprintf(bw, "@enduml\n")
+
+	return bw.Flush()
+}
+
+var mermaidReplacer = strings.NewReplacer("\n", " ", "#", "#35;", ";", "#59;")
+
+// mermaidEscape escapes characters that are special in Mermaid text.
+func mermaidEscape(s string) string {
+	return mermaidReplacer.Replace(s)
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 // GID is a goroutine id.
@@ -26,13 +27,40 @@ type GID int64
 type GCtx struct {
 	GID    GID
 	OpCtxs []OpCtx
+
+	replayChoice int  // The select case forced by the Replay.
+	replayForced bool // True while a select is forced by the Replay.
 }
 
 // OpCtx associates an operation with context.
 type OpCtx struct {
-	Op     Op
-	Stack  string
-	Target interface{} // Depends on the operation; ex: a channel.
+	Op      Op
+	CaseNum int         // The select case position, or -1 when not a select.
+	Begin   int64       // Recorder timestamp of when the operation began.
+	ChanID  ChanID      // Registered id of the target channel or mutex, or 0.
+	Stack   StackID     // Interned call stack of the operation.
+	Target  interface{} // Depends on the operation; ex: a channel.
+
+	// Sampled is false when the operation is filtered out by the
+	// SamplePolicy, so it's not recorded.
+	Sampled bool
+
+	// Deferred is true when the begin event is recorded only if the
+	// operation takes at least the SamplePolicy's MinBlocked.
+	Deferred bool
+
+	// Value is the encoded sent or received message, or "".
+	Value string
+
+	// Closed is true for a receive that returned a zero value because
+	// the channel was closed, when that's known, ex: from the ok of
+	// "v, ok := <-ch".  A receive without an ok can't tell a closed
+	// channel's zero value from a message, so it's not marked closed.
+	Closed bool
+
+	// Holder is the goroutine that held the target mutex's (write)
+	// lock when a lock operation began, or 0 if unknown.
+	Holder GID
 }
 
 type Op int
@@ -45,6 +73,16 @@ const (
 	OP_CH_SELECT_SEND
 	OP_CH_SELECT_RECV
 	OP_CH_RANGE
+	OP_GO
+	OP_MU_LOCK
+	OP_MU_UNLOCK
+	OP_RW_LOCK
+	OP_RW_UNLOCK
+	OP_RW_RLOCK
+	OP_RW_RUNLOCK
+	OP_WG_ADD
+	OP_WG_DONE
+	OP_WG_WAIT
 )
 
 var OpStrings = map[Op]string{
@@ -55,18 +93,55 @@ var OpStrings = map[Op]string{
 	OP_CH_SELECT_SEND: "ch-select-send",
 	OP_CH_SELECT_RECV: "ch-select-recv",
 	OP_CH_RANGE:       "ch-range",
+	OP_GO:             "go",
+	OP_MU_LOCK:        "mu-lock",
+	OP_MU_UNLOCK:      "mu-unlock",
+	OP_RW_LOCK:        "rw-lock",
+	OP_RW_UNLOCK:      "rw-unlock",
+	OP_RW_RLOCK:       "rw-rlock",
+	OP_RW_RUNLOCK:     "rw-runlock",
+	OP_WG_ADD:         "wg-add",
+	OP_WG_DONE:        "wg-done",
+	OP_WG_WAIT:        "wg-wait",
+}
+
+// IsSendOp returns true if the Op sends to a channel.
+func IsSendOp(op Op) bool {
+	return op == OP_CH_SEND || op == OP_CH_SELECT_SEND
+}
+
+// IsRecvOp returns true if the Op receives from a channel.
+func IsRecvOp(op Op) bool {
+	return op == OP_CH_RECV || op == OP_CH_SELECT_RECV || op == OP_CH_RANGE
+}
+
+// IsLockOp returns true if the Op acquires a lock of a mutex.
+func IsLockOp(op Op) bool {
+	return op == OP_MU_LOCK || op == OP_RW_LOCK || op == OP_RW_RLOCK
 }
 
 // ---------------------------------------------------------------
 
+// DefaultStackBufSize is no longer used, as stacks are captured by
+// CaptureStack().
 var DefaultStackBufSize = 1000
 
 var ExpectedStackPrefix = []byte("goroutine ")
 
 var ExpectedStackPrefixLen = len(ExpectedStackPrefix)
 
-// CurrentGID returns the goroutine id.
+// CurrentGID returns the goroutine id, using a fast path that reads
+// the goid directly from the runtime when available.
 func CurrentGID() GID {
+	if goidOffset >= 0 {
+		return GID(readGoid(getg(), goidOffset))
+	}
+	return StackGID()
+}
+
+// StackGID returns the goroutine id by parsing runtime.Stack()
+// output, which is slow but portable.
+func StackGID() GID {
 	buf := make([]byte, 64)
 	n := runtime.Stack(buf, false)
 	buf = buf[0:n]
@@ -85,24 +160,19 @@ func CurrentGID() GID {
 	return GID(gid)
 }
 
-// CurrentStack returns the call stack.  The returned
-// stack string looks like the following (and has "\t" tabs)...
+// CurrentStack returns the call stack, skipping skipFrames frames of
+// the caller.  The returned stack string looks like the following
+// (and has "\t" tabs)...
 //
 // github.com/couchbaselabs/gapture.ExampleStack()
 // 	/Users/steveyen/go/src/github.com/couchbaselabs/gapture/gapture.go:76 +0x3a
 // main.main()
 // 	/Users/steveyen/go/src/github.com/couchbaselabs/gapture/cmd/gapture/main.go:32 +0x195
 //
+// Deprecated: Use CaptureStack(), whose StackID's are cheap to keep
+// and symbolized only when needed.
 func CurrentStack(skipFrames int) string {
-	buf := make([]byte, DefaultStackBufSize)
-	n := runtime.Stack(buf, false)
-	buf = buf[0:n]
-	buf = buf[bytes.IndexByte(buf, '\n')+1:] // Skip first goroutine line.
-	for i := 0; i <= skipFrames; i++ {       // Always skip 1 frame for CurrentStack().
-		buf = buf[bytes.IndexByte(buf, '\n')+1:]
-		buf = buf[bytes.IndexByte(buf, '\n')+1:]
-	}
-	return string(buf)
+	return CaptureStack(skipFrames + 1).Text()
 }
 
 // ---------------------------------------------------------------
@@ -114,34 +184,239 @@ func (gctx *GCtx) EnsureGID() {
 	}
 }
 
-func (gctx *GCtx) AddOpCtx(op Op, target interface{}) interface{} {
+// AddOpCtx records the beginning of an operation, where the site may
+// be nil.
+func (gctx *GCtx) AddOpCtx(op Op, site *Site, target interface{}) interface{} {
+	return gctx.addOpCtx(op, -1, site, target)
+}
+
+// AddOpCtxCase records the beginning of a select case operation.
+func (gctx *GCtx) AddOpCtxCase(op Op, caseNum int, site *Site,
+	target interface{}) interface{} {
+	return gctx.addOpCtx(op, caseNum, site, target)
+}
+
+// addOpCtx is invoked at a fixed call depth from the On* methods, so
+// that the captured stack starts with the instrumented code.
+func (gctx *GCtx) addOpCtx(op Op, caseNum int, site *Site,
+	target interface{}) interface{} {
 	gctx.EnsureGID()
-	gctx.OpCtxs = append(gctx.OpCtxs, OpCtx{
-		Op:     op,
-		Stack:  CurrentStack(2),
-		Target: target,
-	})
+
+	if c := currentChaos(); c != nil {
+		c.perturb(gctx)
+	}
+
+	opCtx := OpCtx{
+		Op:      op,
+		CaseNum: caseNum,
+		Target:  target,
+		Sampled: true,
+	}
+
+	if p := DefaultRecorder.SamplePolicy(); p != nil {
+		opCtx.Sampled, opCtx.Deferred = p.sample(op, site, target, 3)
+		if !opCtx.Sampled { // Fast path, only tracking the op.
+			gctx.OpCtxs = append(gctx.OpCtxs, opCtx)
+			return target
+		}
+	}
+
+	opCtx.Stack = CaptureStack(3)
+
+	chanInfo, _ := DefaultChanRegistry.ObserveSite(target, site)
+	opCtx.ChanID = chanInfo.ID
+	if IsLockOp(op) {
+		opCtx.Holder = chanInfo.Holder
+	}
+
+	if opCtx.Deferred {
+		opCtx.Begin = DefaultRecorder.Now()
+	} else {
+		opCtx.Begin = DefaultRecorder.Record(&Event{
+			Kind:    EVENT_BEGIN,
+			GID:     gctx.GID,
+			Op:      op,
+			CaseNum: caseNum,
+			ChanID:  chanInfo.ID,
+			Len:     chanInfo.Len,
+			Cap:     chanInfo.Cap,
+			Stack:   opCtx.Stack,
+			Holder:  opCtx.Holder,
+		})
+	}
+
+	gctx.OpCtxs = append(gctx.OpCtxs, opCtx)
+
+	pending.set(gctx)
+
 	return target
 }
 
+// ClearOpCtxs records the end of the innermost pending operation,
+// which completed, while the operations that it's nested in remain
+// pending, ex: the send of "out <- <-in" after its receive.
 func (gctx *GCtx) ClearOpCtxs() {
-	gctx.OpCtxs = nil
+	gctx.EndOpCtx(len(gctx.OpCtxs) - 1)
+}
+
+// EndOpCtx records the end of the pending operation at index i,
+// which completed, along with any pending operations after it, which
+// did not complete.  The operations before it remain pending.
+func (gctx *GCtx) EndOpCtx(i int) {
+	if i >= 0 {
+		gctx.endOpCtxs(i, i)
+	}
+}
+
+// DropOpCtxs records the end of every pending operation, which did
+// not complete.  The statement level hooks, such as the mutex hooks,
+// invoke it first, as any operations that are pending then were left
+// pending by a panic, ex: a send on a closed channel, before a
+// deferred "mu.Unlock()".
+func (gctx *GCtx) DropOpCtxs() {
+	if len(gctx.OpCtxs) > 0 {
+		gctx.endOpCtxs(0, -1)
+	}
+}
+
+// EndOpCtxs records the end of every pending operation, where
+// completed is the index of the operation that actually completed
+// (ex: the chosen select case), or -1 if none completed.
+func (gctx *GCtx) EndOpCtxs(completed int) {
+	caseNum := REPLAY_DEFAULT
+	if completed >= 0 && completed < len(gctx.OpCtxs) {
+		caseNum = gctx.OpCtxs[completed].CaseNum
+	}
+
+	gctx.endOpCtxs(0, completed)
+
+	if gctx.replayForced {
+		gctx.replaySelectDone(caseNum)
+	}
+}
+
+// endOpCtxs records the end of the pending operations from index
+// first onwards, where completed is the index of the operation that
+// actually completed, or -1.
+func (gctx *GCtx) endOpCtxs(first, completed int) {
+	var sampled bool
+
+	for i := first; i < len(gctx.OpCtxs); i++ {
+		opCtx := &gctx.OpCtxs[i]
+		if !opCtx.Sampled {
+			continue
+		}
+		sampled = true
+
+		chanInfo, _ := DefaultChanRegistry.Observe(opCtx.Target)
+
+		if opCtx.Deferred {
+			ts := DefaultRecorder.Now()
+
+			p := DefaultRecorder.SamplePolicy()
+			if p != nil && time.Duration(ts-opCtx.Begin) < p.MinBlocked {
+				if i == completed {
+					DefaultChanRegistry.Touch(opCtx.Target, gctx.GID, opCtx.Op, ts)
+				}
+				continue
+			}
+
+			DefaultRecorder.RecordDeferred(&Event{
+				Kind:    EVENT_BEGIN,
+				TS:      opCtx.Begin,
+				GID:     gctx.GID,
+				Op:      opCtx.Op,
+				CaseNum: opCtx.CaseNum,
+				ChanID:  chanInfo.ID,
+				Len:     chanInfo.Len,
+				Cap:     chanInfo.Cap,
+				Stack:   opCtx.Stack,
+				Holder:  opCtx.Holder,
+			})
+		}
+
+		var value string
+		var closed bool
+		if i == completed {
+			if IsRecvOp(opCtx.Op) {
+				closed = opCtx.Closed
+			}
+
+			if !closed { // A closed receive's zero value isn't a message.
+				value = opCtx.Value
+			}
+		}
+
+		ts := DefaultRecorder.Record(&Event{
+			Kind:      EVENT_END,
+			GID:       gctx.GID,
+			Op:        opCtx.Op,
+			CaseNum:   opCtx.CaseNum,
+			ChanID:    chanInfo.ID,
+			Len:       chanInfo.Len,
+			Cap:       chanInfo.Cap,
+			Stack:     opCtx.Stack,
+			Completed: i == completed,
+			Value:     value,
+			Closed:    closed,
+		})
+
+		if i == completed && !closed {
+			DefaultChanRegistry.Touch(opCtx.Target, gctx.GID, opCtx.Op, ts)
+
+			if IsSendOp(opCtx.Op) {
+				replaySent(opCtx)
+			}
+		}
+	}
+
+	gctx.OpCtxs = gctx.OpCtxs[:first]
+
+	if sampled {
+		pending.set(gctx)
+	}
+}
+
+// FindCaseNum returns the index of the pending select operation for
+// the given caseNum, or -1.
+func (gctx *GCtx) FindCaseNum(caseNum int) int {
+	for i := range gctx.OpCtxs {
+		if gctx.OpCtxs[i].CaseNum == caseNum {
+			return i
+		}
+	}
+	return -1
 }
 
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanClose(ch interface{}) interface{} {
-	return gctx.AddOpCtx(OP_CH_CLOSE, ch)
+// The On* hooks of the beginning of operations take the Site of the
+// instrumented code, which may be nil.
+
+func (gctx *GCtx) OnChanClose(site *Site, ch interface{}) interface{} {
+	return gctx.AddOpCtx(OP_CH_CLOSE, site, ch)
 }
 
 func (gctx *GCtx) OnChanCloseDone() {
+	if n := len(gctx.OpCtxs); n > 0 {
+		DefaultChanRegistry.MarkClosed(gctx.OpCtxs[n-1].Target)
+	}
 	gctx.ClearOpCtxs()
 }
 
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanSend(ch interface{}) interface{} {
-	return gctx.AddOpCtx(OP_CH_SEND, ch)
+func (gctx *GCtx) OnChanSend(site *Site, ch interface{}) interface{} {
+	rv := gctx.AddOpCtx(OP_CH_SEND, site, ch)
+	gctx.replaySend()
+	return rv
+}
+
+// OnChanSendValue passes through the value of the most recently
+// begun send, remembering it for the send's end event.
+func (gctx *GCtx) OnChanSendValue(v interface{}) interface{} {
+	gctx.setValue(len(gctx.OpCtxs)-1, v)
+	return v
 }
 
 func (gctx *GCtx) OnChanSendDone() {
@@ -150,67 +425,118 @@ func (gctx *GCtx) OnChanSendDone() {
 
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanRecv(ch interface{}) interface{} {
-	return gctx.AddOpCtx(OP_CH_RECV, ch)
+func (gctx *GCtx) OnChanRecv(site *Site, ch interface{}) interface{} {
+	return gctx.AddOpCtx(OP_CH_RECV, site, ch)
 }
 
+// OnChanRecvDone passes through the received value, remembering it
+// for the end event unless it's nil, which means unknown.
 func (gctx *GCtx) OnChanRecvDone(v interface{}) interface{} {
+	if v != nil {
+		gctx.setValue(len(gctx.OpCtxs)-1, v)
+	}
 	gctx.ClearOpCtxs()
 	return v
 }
 
+// OnChanRecvOkDone is like OnChanRecvDone, but for the "v, ok := <-ch"
+// form, where ok is false if the channel was closed.
+func (gctx *GCtx) OnChanRecvOkDone(v interface{}, ok bool) {
+	if ok && v != nil {
+		gctx.setValue(len(gctx.OpCtxs)-1, v)
+	}
+	gctx.setClosed(len(gctx.OpCtxs)-1, !ok)
+	gctx.ClearOpCtxs()
+}
+
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanSelectSend(caseNum int, ch interface{}) interface{} {
+func (gctx *GCtx) OnChanSelectSend(site *Site, caseNum int,
+	ch interface{}) interface{} {
 	if len(gctx.OpCtxs) > caseNum {
 		panic("unexpected gapture.OnChanSelectSend caseNum")
 	}
-	return gctx.AddOpCtx(OP_CH_SELECT_SEND, ch)
+	return gctx.replaySelectCase(caseNum,
+		gctx.AddOpCtxCase(OP_CH_SELECT_SEND, caseNum, site, ch))
 }
 
 func (gctx *GCtx) OnChanSelectSendDone(caseNum int) {
-	gctx.ClearOpCtxs()
+	gctx.EndOpCtxs(gctx.FindCaseNum(caseNum))
 }
 
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanSelectRecv(caseNum int, ch interface{}) interface{} {
+func (gctx *GCtx) OnChanSelectRecv(site *Site, caseNum int,
+	ch interface{}) interface{} {
 	if len(gctx.OpCtxs) > caseNum {
 		panic("unexpected gapture.OnChanSelectRecv caseNum")
 	}
-	return gctx.AddOpCtx(OP_CH_SELECT_RECV, ch)
+	return gctx.replaySelectCase(caseNum,
+		gctx.AddOpCtxCase(OP_CH_SELECT_RECV, caseNum, site, ch))
 }
 
 func (gctx *GCtx) OnChanSelectRecvDone(caseNum int) {
-	gctx.ClearOpCtxs()
+	gctx.EndOpCtxs(gctx.FindCaseNum(caseNum))
+}
+
+// OnChanSelectRecvValueDone is like OnChanSelectRecvDone, but also
+// remembers the received value.
+func (gctx *GCtx) OnChanSelectRecvValueDone(caseNum int, v interface{}) {
+	i := gctx.FindCaseNum(caseNum)
+	gctx.setValue(i, v)
+	gctx.EndOpCtxs(i)
+}
+
+// OnChanSelectRecvOkDone is like OnChanSelectRecvValueDone, but for
+// the "case v, ok := <-ch" form, where ok is false if the channel was
+// closed.
+func (gctx *GCtx) OnChanSelectRecvOkDone(caseNum int, v interface{}, ok bool) {
+	i := gctx.FindCaseNum(caseNum)
+	if ok && v != nil {
+		gctx.setValue(i, v)
+	}
+	gctx.setClosed(i, !ok)
+	gctx.EndOpCtxs(i)
 }
 
 // ---------------------------------------------------------------
 
 func (gctx *GCtx) OnChanSelectDefault() {
-	gctx.ClearOpCtxs()
+	gctx.EndOpCtxs(-1)
 }
 
 // ---------------------------------------------------------------
 
-func (gctx *GCtx) OnChanRange(ch interface{}) interface{} {
-	return gctx.AddOpCtx(OP_CH_RANGE, ch)
+func (gctx *GCtx) OnChanRange(site *Site, ch interface{}) interface{} {
+	return gctx.AddOpCtx(OP_CH_RANGE, site, ch)
 }
 
-func (gctx *GCtx) OnChanRangeBody() interface{} {
+// OnChanRangeBody is invoked at the start of each iteration of a range
+// loop with the received value, or nil if the loop has no variable.
+func (gctx *GCtx) OnChanRangeBody(v interface{}) interface{} {
 	if len(gctx.OpCtxs) != 1 ||
 		gctx.OpCtxs[0].Op != OP_CH_RANGE {
 		panic("unexpected gapture.OnChanRangeBody")
 	}
+	if v != nil {
+		gctx.setValue(0, v)
+	}
+	gctx.setClosed(0, false) // The body runs only after a message.
 	rv := gctx.OpCtxs[0].Target
 	gctx.ClearOpCtxs()
 	return rv
 }
 
 func (gctx *GCtx) OnChanRangeBodyContinue(ch interface{}) {
-	gctx.AddOpCtx(OP_CH_RANGE, ch)
+	gctx.AddOpCtx(OP_CH_RANGE, nil, ch)
 }
 
+// OnChanRangeDone is invoked after a range loop.  If the range
+// receive is still pending, then the loop ended because the channel
+// was closed, as opposed to a break or return.
 func (gctx *GCtx) OnChanRangeDone() {
+	if len(gctx.OpCtxs) == 1 && gctx.OpCtxs[0].Op == OP_CH_RANGE {
+		gctx.setClosed(0, true)
+	}
 	gctx.ClearOpCtxs()
 }
@@ -0,0 +1,92 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"unsafe"
+)
+
+// goidMaxOffset is how many bytes of the runtime's g struct are
+// searched for the goid field.  The g struct is always larger.
+const goidMaxOffset = 256
+
+// goidOffset is the byte offset of the goid field in the runtime's
+// g struct, or -1 when the fast path is unavailable.
+var goidOffset = findGoidOffset()
+
+// findGoidOffset locates the goid field without depending on a
+// particular go version's g struct layout, by searching the current
+// g for the goid reported by StackGID(), and then confirming the
+// candidate offsets on other goroutines, which have different goids.
+func findGoidOffset() int {
+	g := getg()
+	if g == nil {
+		return -1
+	}
+
+	candidates := goidCandidates(g, StackGID(), nil)
+
+	for tries := 0; tries < 3 && len(candidates) > 1; tries++ {
+		ch := make(chan []int)
+		go func(candidates []int) {
+			ch <- goidCandidates(getg(), StackGID(), candidates)
+		}(candidates)
+		candidates = <-ch
+	}
+
+	if len(candidates) != 1 {
+		return -1
+	}
+
+	// One last confirmation on a separate goroutine.
+	ch := make(chan []int)
+	go func() {
+		ch <- goidCandidates(getg(), StackGID(), candidates)
+	}()
+	if len(<-ch) != 1 {
+		return -1
+	}
+
+	return candidates[0]
+}
+
+// goidCandidates returns the offsets in g that hold the given gid,
+// limited to the given offsets when non-nil.
+func goidCandidates(g unsafe.Pointer, gid GID, offsets []int) []int {
+	var rv []int
+
+	if offsets == nil {
+		for offset := 0; offset+8 <= goidMaxOffset; offset += 8 {
+			if readGoid(g, offset) == int64(gid) {
+				rv = append(rv, offset)
+			}
+		}
+	} else {
+		for _, offset := range offsets {
+			if readGoid(g, offset) == int64(gid) {
+				rv = append(rv, offset)
+			}
+		}
+	}
+
+	return rv
+}
+
+func readGoid(g unsafe.Pointer, offset int) int64 {
+	return *(*int64)(unsafe.Add(g, offset))
+}
+
+// HasFastGID returns true if CurrentGID() reads the goid directly,
+// rather than falling back to StackGID().
+func HasFastGID() bool {
+	return goidOffset >= 0
+}
@@ -0,0 +1,69 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCurrentGIDMatchesStackGID(t *testing.T) {
+	if !HasFastGID() {
+		t.Log("fast path unavailable, CurrentGID() uses StackGID()")
+	}
+
+	if CurrentGID() != StackGID() {
+		t.Fatalf("CurrentGID() %d != StackGID() %d", CurrentGID(), StackGID())
+	}
+
+	const numGoroutines = 100
+
+	gids := make([]GID, numGoroutines)
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				fast, slow := CurrentGID(), StackGID()
+				if fast != slow {
+					t.Errorf("goroutine %d, CurrentGID() %d != StackGID() %d",
+						i, fast, slow)
+					return
+				}
+				gids[i] = fast
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[GID]bool{}
+	for i, gid := range gids {
+		if seen[gid] {
+			t.Errorf("goroutine %d, duplicate gid %d", i, gid)
+		}
+		seen[gid] = true
+	}
+}
+
+func BenchmarkCurrentGID(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		CurrentGID()
+	}
+}
+
+func BenchmarkStackGID(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		StackGID()
+	}
+}
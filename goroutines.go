@@ -0,0 +1,138 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// GoroutineInfo is what's known about a goroutine that was spawned
+// by an instrumented go statement or that was named by SetName().
+type GoroutineInfo struct {
+	GID GID
+
+	// Name is from SetName(), or else automatic from the spawned
+	// func and its count of spawns, ex: "main.worker#3".
+	Name string
+
+	Parent GID     // Or 0 if not spawned by an instrumented go statement.
+	Func   string  // The spawned func, ex: "main.worker".
+	Stack  StackID // Where the go statement was executed.
+}
+
+var goroutines = struct {
+	m      sync.RWMutex           // Protects the fields that follow.
+	infos  map[GID]*GoroutineInfo // Of live goroutines.
+	spawns map[string]int         // Keyed by func, the count of spawns.
+}{
+	infos:  map[GID]*GoroutineInfo{},
+	spawns: map[string]int{},
+}
+
+// SetName labels the current goroutine, ex: gapture.SetName("worker-3"),
+// which is shown instead of its GID by the reports and exporters.
+func SetName(name string) {
+	SetGoroutineName(CurrentGID(), name)
+}
+
+// SetGoroutineName labels a goroutine.  A goroutine that was not
+// spawned by an instrumented go statement is remembered until the
+// process exits, so it should be a long lived goroutine, ex: main.
+func SetGoroutineName(gid GID, name string) {
+	goroutines.m.Lock()
+	g := goroutines.infos[gid]
+	if g == nil {
+		g = &GoroutineInfo{GID: gid}
+		goroutines.infos[gid] = g
+	}
+	g.Name = name
+	info := *g
+	goroutines.m.Unlock()
+
+	for _, sink := range DefaultRecorder.Sinks() {
+		if s, ok := sink.(*TraceSink); ok {
+			s.WriteGoroutine(info)
+		}
+	}
+}
+
+// LookupGoroutine returns what's known about a live goroutine.
+func LookupGoroutine(gid GID) (info GoroutineInfo, ok bool) {
+	goroutines.m.RLock()
+	g := goroutines.infos[gid]
+	if g != nil {
+		info, ok = *g, true
+	}
+	goroutines.m.RUnlock()
+
+	return info, ok
+}
+
+// GoroutineName returns the display name of a goroutine, which is
+// "goroutine N" when it has no name.
+func GoroutineName(gid GID) string {
+	if info, ok := LookupGoroutine(gid); ok && info.Name != "" {
+		return info.Name
+	}
+	return fmt.Sprintf("goroutine %d", gid)
+}
+
+// GoroutineNames returns the display names of goroutines.
+func GoroutineNames(gids []GID) []string {
+	rv := make([]string, 0, len(gids))
+	for _, gid := range gids {
+		rv = append(rv, GoroutineName(gid))
+	}
+	return rv
+}
+
+// Goroutines returns what's known about the live goroutines, ordered
+// by GID.
+func Goroutines() []GoroutineInfo {
+	goroutines.m.RLock()
+	rv := make([]GoroutineInfo, 0, len(goroutines.infos))
+	for _, g := range goroutines.infos {
+		rv = append(rv, *g)
+	}
+	goroutines.m.RUnlock()
+
+	sort.Slice(rv, func(i, j int) bool { return rv[i].GID < rv[j].GID })
+
+	return rv
+}
+
+// addGoroutine remembers a spawned goroutine, assigning its automatic
+// name.
+func addGoroutine(info GoroutineInfo) GoroutineInfo {
+	goroutines.m.Lock()
+	n := goroutines.spawns[info.Func] + 1
+	goroutines.spawns[info.Func] = n
+	if info.Name == "" {
+		info.Name = info.Func + "#" + strconv.Itoa(n)
+	}
+	g := info
+	goroutines.infos[info.GID] = &g
+	goroutines.m.Unlock()
+
+	return info
+}
+
+// delGoroutine forgets a goroutine that exited.
+func delGoroutine(gid GID) {
+	goroutines.m.Lock()
+	delete(goroutines.infos, gid)
+	goroutines.m.Unlock()
+	forgetChaosCount(gid)
+}
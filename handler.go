@@ -0,0 +1,268 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHandlerEvents is how many recent events the Handler serves,
+// unless overridden by the "n" query parameter.
+var DefaultHandlerEvents = 100
+
+// HandlerState is the live state served by the Handler.
+type HandlerState struct {
+	Goroutines []HandlerGoroutine `json:"goroutines"`
+	Chans      []HandlerChan      `json:"chans"`
+	Events     []HandlerEvent     `json:"events"`
+}
+
+type HandlerGoroutine struct {
+	GID  GID         `json:"gid"`
+	Name string      `json:"name"`
+	Ops  []HandlerOp `json:"ops"`
+}
+
+type HandlerOp struct {
+	Op        string        `json:"op"`
+	CaseNum   int           `json:"case"`
+	ChanID    ChanID        `json:"chan"`
+	Blocked   time.Duration `json:"blockedNanos"`
+	Stack     string        `json:"stack"`
+	Senders   []GID         `json:"senders"`   // Recent other senders.
+	Receivers []GID         `json:"receivers"` // Recent other receivers.
+	Holders   []GID         `json:"holders,omitempty"`
+
+	// Outstanding and Adders are of the WaitGroup of a Wait().
+	Outstanding int      `json:"outstanding,omitempty"`
+	Adders      []GID    `json:"adders,omitempty"`
+	AdderNames  []string `json:"adderNames,omitempty"` // See AdderNames().
+}
+
+type HandlerChan struct {
+	ID      ChanID   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Site    string   `json:"site,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+	Tags    Tags     `json:"tags,omitempty"`
+	Type    string   `json:"type"`
+	Elem    string   `json:"elem"`
+	Len     int      `json:"len"`
+	Cap     int      `json:"cap"`
+	Closed  bool     `json:"closed"`
+
+	// Of an instrumented make(chan), the creating goroutine and the
+	// "file.go:line" and func of the make.
+	Creator     GID    `json:"creator,omitempty"`
+	CreatorName string `json:"creatorName,omitempty"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+	CreatedIn   string `json:"createdIn,omitempty"`
+}
+
+type HandlerEvent struct {
+	Kind      string `json:"kind"`
+	TS        int64  `json:"ts"`
+	GID       GID    `json:"gid"`
+	Name      string `json:"name"` // Of the goroutine.
+	Op        string `json:"op"`
+	CaseNum   int    `json:"case"`
+	ChanID    ChanID `json:"chan"`
+	Len       int    `json:"len"`
+	Cap       int    `json:"cap"`
+	Site      string `json:"site"`
+	Completed bool   `json:"completed"`
+	Value     string `json:"value,omitempty"`
+	Closed    bool   `json:"closed,omitempty"`
+	Parent    GID    `json:"parent,omitempty"` // Of a spawn.
+	Func      string `json:"func,omitempty"`   // Of a spawn.
+	Panicked  bool   `json:"panicked,omitempty"`
+	Holder    GID    `json:"holder,omitempty"` // Of a lock.
+}
+
+// Handler returns an http.Handler that serves the live goroutines
+// that have pending operations, the channel registry and the recent
+// events, as HTML or as JSON (with "?format=json" or an Accept header
+// of "application/json").  It's opt-in and can be mounted next to
+// net/http/pprof, ex:
+//
+//	http.Handle("/debug/gapture", gapture.Handler())
+func Handler() http.Handler {
+	return http.HandlerFunc(serveHTTP)
+}
+
+func serveHTTP(w http.ResponseWriter, req *http.Request) {
+	n := DefaultHandlerEvents
+	if v := req.FormValue("n"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil && i >= 0 {
+			n = i
+		}
+	}
+
+	state := CurrentHandlerState(n)
+
+	if req.FormValue("format") == "json" ||
+		strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(state)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	handlerTemplate.Execute(w, state)
+}
+
+// CurrentHandlerState returns the live state, with up to maxEvents
+// of the most recent events.
+func CurrentHandlerState(maxEvents int) *HandlerState {
+	state := &HandlerState{
+		Goroutines: []HandlerGoroutine{},
+		Chans:      []HandlerChan{},
+		Events:     []HandlerEvent{},
+	}
+
+	for _, gv := range Snapshot().Goroutines {
+		g := HandlerGoroutine{GID: gv.GID, Name: gv.Name}
+		for _, ov := range gv.Ops {
+			op := HandlerOp{
+				Op:        OpStrings[ov.Op],
+				CaseNum:   ov.CaseNum,
+				ChanID:    ov.Chan.ID,
+				Blocked:   ov.Blocked,
+				Stack:     ov.Stack,
+				Senders:   toucherGIDs(ov.Senders),
+				Receivers: toucherGIDs(ov.Receivers),
+				Holders:   ov.Holders,
+			}
+			if ov.Op == OP_WG_WAIT {
+				op.Outstanding = ov.Chan.Len
+				op.Adders = AdderGIDs(ov.Adders)
+				op.AdderNames = AdderNames(ov.Adders)
+			}
+			g.Ops = append(g.Ops, op)
+		}
+		state.Goroutines = append(state.Goroutines, g)
+	}
+
+	for _, c := range DefaultChanRegistry.Chans() {
+		state.Chans = append(state.Chans, HandlerChan{
+			ID:      c.ID,
+			Name:    c.Name,
+			Site:    c.Site,
+			Aliases: c.Aliases,
+			Tags:    c.Tags,
+			Type:    c.Type,
+			Elem:    c.Elem,
+			Len:     c.Len,
+			Cap:     c.Cap,
+			Closed:  c.Closed,
+
+			Creator:     c.Creator,
+			CreatorName: c.CreatorName,
+			CreatedAt:   c.Created.Site(),
+			CreatedIn:   c.Created.Func(),
+		})
+	}
+
+	events := DefaultRecorder.Events()
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+
+	for _, e := range events {
+		state.Events = append(state.Events, HandlerEvent{
+			Kind:      EventKindStrings[e.Kind],
+			TS:        e.TS,
+			GID:       e.GID,
+			Name:      GoroutineName(e.GID),
+			Op:        OpStrings[e.Op],
+			CaseNum:   e.CaseNum,
+			ChanID:    e.ChanID,
+			Len:       e.Len,
+			Cap:       e.Cap,
+			Site:      e.Stack.Site(),
+			Completed: e.Completed,
+			Value:     e.Value,
+			Closed:    e.Closed,
+			Parent:    e.Parent,
+			Func:      e.Func,
+			Panicked:  e.Panicked,
+			Holder:    e.Holder,
+		})
+	}
+
+	return state
+}
+
+func toucherGIDs(touchers []Toucher) []GID {
+	rv := []GID{}
+	for _, t := range touchers {
+		rv = append(rv, t.GID)
+	}
+	return rv
+}
+
+var handlerTemplate = template.Must(template.New("gapture").Funcs(template.FuncMap{
+	"name":     GoroutineName,
+	"chanName": ChanName,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>gapture</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; vertical-align: top; }
+pre { margin: 0; }
+</style>
+</head>
+<body>
+<p><a href="?format=json">json</a></p>
+
+<h2>Goroutines with pending operations ({{len .Goroutines}})</h2>
+<table>
+<tr><th>goroutine</th><th>op</th><th>case</th><th>chan</th><th>blocked</th><th>senders</th><th>receivers</th><th>holders / adders</th><th>stack</th></tr>
+{{range $g := .Goroutines}}{{range .Ops}}
+<tr><td>{{$g.Name}}</td><td>{{.Op}}</td><td>{{if ge .CaseNum 0}}{{.CaseNum}}{{end}}</td>
+<td>{{if .ChanID}}{{chanName .ChanID}}{{end}}</td><td>{{.Blocked}}</td>
+<td>{{range .Senders}}{{name .}}<br>{{end}}</td><td>{{range .Receivers}}{{name .}}<br>{{end}}</td>
+<td>{{range .Holders}}{{name .}}<br>{{end}}{{if eq .Op "wg-wait"}}{{.Outstanding}} outstanding<br>{{range .AdderNames}}{{.}}<br>{{end}}{{end}}</td><td><pre>{{.Stack}}</pre></td></tr>
+{{end}}{{end}}
+</table>
+
+<h2>Channels ({{len .Chans}})</h2>
+<table>
+<tr><th>id</th><th>name</th><th>tags</th><th>site</th><th>aliases</th><th>type</th><th>len</th><th>cap</th><th>closed</th><th>created</th></tr>
+{{range .Chans}}
+<tr><td>#{{.ID}}</td><td>{{.Name}}</td><td>{{range $k, $v := .Tags}}{{$k}}={{$v}}<br>{{end}}</td><td>{{.Site}}</td><td>{{range .Aliases}}{{.}}<br>{{end}}</td><td>{{.Type}}</td><td>{{.Len}}</td><td>{{.Cap}}</td><td>{{.Closed}}</td>
+<td>{{if .Creator}}by {{.CreatorName}} in {{.CreatedIn}}() at {{.CreatedAt}}{{end}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent events ({{len .Events}})</h2>
+<table>
+<tr><th>ts</th><th>kind</th><th>goroutine</th><th>op</th><th>case</th><th>chan</th><th>len/cap</th><th>site</th><th>completed</th><th>value</th></tr>
+{{range .Events}}
+<tr><td>{{.TS}}</td><td>{{.Kind}}</td><td>{{.Name}}</td><td>{{.Op}}</td>
+<td>{{if ge .CaseNum 0}}{{.CaseNum}}{{end}}</td><td>{{if .ChanID}}#{{.ChanID}}{{end}}</td>
+<td>{{.Len}}/{{.Cap}}</td><td>{{.Site}}</td><td>{{.Completed}}{{if .Closed}} (closed){{end}}</td><td>{{.Value}}{{if .Func}}{{.Func}} from {{name .Parent}}{{end}}{{if .Panicked}}panicked{{end}}{{if .Holder}}held by {{name .Holder}}{{end}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
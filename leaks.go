@@ -0,0 +1,162 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// OnMakeChan is invoked with the result of an instrumented
+// make(chan), ex: "gapture.OnMakeChan(site, make(chan int, 10)).(chan int)",
+// and registers the channel along with the goroutine and stack that
+// created it.  It's a func rather than a GCtx method, so that it can
+// be used by package level var initializers.
+func OnMakeChan(site *Site, ch interface{}) interface{} {
+	DefaultChanRegistry.Made(ch, site,
+		CurrentGID(), CaptureStack(1), DefaultRecorder.Now())
+
+	return ch
+}
+
+// ---------------------------------------------------------------
+
+// A ChanLeak is a channel that was created by an instrumented
+// make(chan) and that has not been closed.
+type ChanLeak struct {
+	Chan ChanInfo
+	Age  time.Duration // Since the channel was created.
+
+	// CreatorAlive is whether the goroutine that created the channel
+	// is still alive.
+	CreatorAlive bool
+}
+
+// ChanLeakReport lists the channels that might have leaked.
+type ChanLeakReport struct {
+	Leaks []ChanLeak // Ordered by ChanID.
+}
+
+// FindChanLeaks returns a report of the channels that were created
+// by an instrumented make(chan) at least minAge ago, that have not
+// been closed, and that are still in use: a live goroutine has an
+// operation pending on the channel, or sent to or received from it
+// within the last minAge.  It returns nil if there are none.
+//
+// Not every unclosed channel is a leak, but an unclosed channel
+// whose creator has exited often means that its readers are stuck.
+// The registry does not hold references to channels, so unclosed
+// channels that are no longer in use are not reported, as most of
+// them, ex: reply channels, have been garbage collected.
+//
+// FindChanLeaks uses runtime.Stack() of all goroutines to learn which
+// goroutines are alive, which briefly stops the world.
+func FindChanLeaks(minAge time.Duration) *ChanLeakReport {
+	live := LiveGIDs()
+
+	now := DefaultRecorder.Now()
+
+	inUse := map[ChanID]bool{}
+	for _, p := range pending.all() {
+		if live[p.GID] {
+			for _, opCtx := range p.OpCtxs {
+				inUse[opCtx.ChanID] = true
+			}
+		}
+	}
+
+	touchedSince := func(touchers []Toucher) bool {
+		for _, t := range touchers {
+			if live[t.GID] && time.Duration(now-t.TS) < minAge {
+				return true
+			}
+		}
+		return false
+	}
+
+	var leaks []ChanLeak
+
+	for _, c := range DefaultChanRegistry.Chans() {
+		if c.Creator == 0 || c.Closed {
+			continue
+		}
+
+		age := time.Duration(now - c.CreatedTS)
+		if age < minAge {
+			continue
+		}
+
+		if !inUse[c.ID] {
+			senders, receivers := DefaultChanRegistry.TouchersID(c.ID)
+			if !touchedSince(senders) && !touchedSince(receivers) {
+				continue
+			}
+		}
+
+		leaks = append(leaks, ChanLeak{
+			Chan:         c,
+			Age:          age,
+			CreatorAlive: live[c.Creator],
+		})
+	}
+
+	if len(leaks) <= 0 {
+		return nil
+	}
+
+	return &ChanLeakReport{Leaks: leaks}
+}
+
+// String returns a human readable list of the leaks, including the
+// stacks where the channels were created.
+func (r *ChanLeakReport) String() string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "chan leaks: %d channel(s) never closed\n", len(r.Leaks))
+
+	for _, leak := range r.Leaks {
+		b.WriteString("  " + leak.String() + "\n")
+		b.WriteString(indentLines(leak.Chan.Created.Text(), "    "))
+	}
+
+	return b.String()
+}
+
+// String returns a one line description of the leak, ex:
+// "chan subtasks (worker.go:30) of int, cap 0, created by
+// main.worker#3 in main.worker() 5s ago and never closed".
+func (leak ChanLeak) String() string {
+	c := &leak.Chan
+
+	creator := c.CreatorName
+	if creator == "" {
+		creator = fmt.Sprintf("goroutine %d", c.Creator)
+	}
+	if !leak.CreatorAlive {
+		creator += " (exited)"
+	}
+
+	in := ""
+	if fn := c.Created.Func(); fn != "" {
+		in = " in " + fn + "()"
+	}
+
+	buffered := ""
+	if c.Len > 0 {
+		buffered = fmt.Sprintf(", %d buffered", c.Len)
+	}
+
+	return fmt.Sprintf("%s of %s, cap %d%s, created by %s%s %v ago"+
+		" and never closed", ChanName(c.ID), c.Elem, c.Cap, buffered,
+		creator, in, leak.Age)
+}
@@ -0,0 +1,89 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sync"
+)
+
+// The mutex hooks replace the method calls on sync.Mutex and
+// sync.RWMutex values, ex: "s.mu.Lock()" is converted into
+// "gaptureGCtx.OnMuLock(gaptureSite_f_1_2, &s.mu)".  Unlike the
+// channel hooks, they perform the operation themselves, so that
+// "defer s.mu.Unlock()" still unlocks when the func returns.
+//
+// A lock operation is pending while it waits for the lock, so it's
+// seen by the stall watchdog, FindDeadlocks() and Snapshot(), and
+// its begin event records the goroutine that held the lock.  An
+// unlock operation never blocks, so it begins and ends at once.
+// Operations that a panic left pending are dropped first, see
+// DropOpCtxs().
+
+func (gctx *GCtx) OnMuLock(site *Site, mu *sync.Mutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_MU_LOCK, site, mu)
+	mu.Lock()
+	gctx.locked(mu, false)
+}
+
+func (gctx *GCtx) OnMuUnlock(site *Site, mu *sync.Mutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_MU_UNLOCK, site, mu)
+	gctx.unlocked(mu, false)
+	mu.Unlock()
+}
+
+// ---------------------------------------------------------------
+
+func (gctx *GCtx) OnRWLock(site *Site, rw *sync.RWMutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_RW_LOCK, site, rw)
+	rw.Lock()
+	gctx.locked(rw, false)
+}
+
+func (gctx *GCtx) OnRWUnlock(site *Site, rw *sync.RWMutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_RW_UNLOCK, site, rw)
+	gctx.unlocked(rw, false)
+	rw.Unlock()
+}
+
+func (gctx *GCtx) OnRWRLock(site *Site, rw *sync.RWMutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_RW_RLOCK, site, rw)
+	rw.RLock()
+	gctx.locked(rw, true)
+}
+
+func (gctx *GCtx) OnRWRUnlock(site *Site, rw *sync.RWMutex) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_RW_RUNLOCK, site, rw)
+	gctx.unlocked(rw, true)
+	rw.RUnlock()
+}
+
+// ---------------------------------------------------------------
+
+// locked records that the pending lock operation acquired the lock.
+// The operation is the only pending one, see DropOpCtxs().
+func (gctx *GCtx) locked(mu interface{}, read bool) {
+	DefaultChanRegistry.Acquire(mu, gctx.GID, read)
+	gctx.EndOpCtx(0)
+}
+
+// unlocked records the unlock operation before the lock is actually
+// released, so that the next holder is not overwritten.
+func (gctx *GCtx) unlocked(mu interface{}, read bool) {
+	DefaultChanRegistry.Release(mu, gctx.GID, read)
+	gctx.EndOpCtx(0)
+}
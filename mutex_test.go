@@ -0,0 +1,139 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pendingOf returns the pending operations of a goroutine, if any.
+func pendingOf(gid GID) []OpCtx {
+	for _, p := range pending.all() {
+		if p.GID == gid {
+			return p.OpCtxs
+		}
+	}
+	return nil
+}
+
+func TestMutexHolders(t *testing.T) {
+	rw := &sync.RWMutex{}
+	testKeepAlive = append(testKeepAlive, rw)
+
+	gctxs := map[GID]*GCtx{}
+	gctx := func(gid GID) *GCtx {
+		if gctxs[gid] == nil {
+			gctxs[gid] = &GCtx{GID: gid}
+		}
+		return gctxs[gid]
+	}
+
+	tests := []struct {
+		gid     GID
+		op      func(gctx *GCtx, rw *sync.RWMutex)
+		holder  GID
+		readers []GID
+	}{
+		{101, func(g *GCtx, rw *sync.RWMutex) { g.OnRWRLock(nil, rw) }, 0, []GID{101}},
+		{102, func(g *GCtx, rw *sync.RWMutex) { g.OnRWRLock(nil, rw) }, 0, []GID{101, 102}},
+		{101, func(g *GCtx, rw *sync.RWMutex) { g.OnRWRUnlock(nil, rw) }, 0, []GID{102}},
+		{102, func(g *GCtx, rw *sync.RWMutex) { g.OnRWRUnlock(nil, rw) }, 0, nil},
+		{103, func(g *GCtx, rw *sync.RWMutex) { g.OnRWLock(nil, rw) }, 103, nil},
+		{103, func(g *GCtx, rw *sync.RWMutex) { g.OnRWUnlock(nil, rw) }, 0, nil},
+	}
+
+	for i, test := range tests {
+		g := gctx(test.gid)
+		test.op(g, rw)
+
+		info, ok := DefaultChanRegistry.Lookup(rw)
+		if !ok {
+			t.Fatalf("step %d, expected the mutex to be registered", i)
+		}
+		if info.Holder != test.holder {
+			t.Errorf("step %d, holder, got: %d, expected: %d", i, info.Holder, test.holder)
+		}
+		if len(info.Readers) != len(test.readers) ||
+			(len(test.readers) > 0 && !reflect.DeepEqual(info.Readers, test.readers)) {
+			t.Errorf("step %d, readers, got: %v, expected: %v", i, info.Readers, test.readers)
+		}
+		if len(g.OpCtxs) != 0 || len(pendingOf(test.gid)) != 0 {
+			t.Errorf("step %d, expected no pending ops, got: %+v", i, g.OpCtxs)
+		}
+	}
+}
+
+func TestMutexLockWaitsForHolder(t *testing.T) {
+	mu := &sync.Mutex{}
+	testKeepAlive = append(testKeepAlive, mu)
+
+	holder := &GCtx{}
+	holder.OnMuLock(nil, mu)
+
+	gidCh := make(chan GID)
+	doneCh := make(chan struct{})
+	go func() {
+		var gctx GCtx
+		gctx.EnsureGID()
+		gidCh <- gctx.GID
+		gctx.OnMuLock(nil, mu)
+		gctx.OnMuUnlock(nil, mu)
+		close(doneCh)
+	}()
+	gid := <-gidCh
+
+	var opCtxs []OpCtx
+	for i := 0; i < 1000 && len(opCtxs) <= 0; i++ {
+		time.Sleep(time.Millisecond)
+		opCtxs = pendingOf(gid)
+	}
+	if len(opCtxs) != 1 || opCtxs[0].Op != OP_MU_LOCK {
+		t.Fatalf("expected a pending lock, got: %+v", opCtxs)
+	}
+	if opCtxs[0].Holder != holder.GID {
+		t.Errorf("begin holder, got: %d, expected: %d", opCtxs[0].Holder, holder.GID)
+	}
+	if got := lockHolders(opCtxs[0]); !reflect.DeepEqual(got, []GID{holder.GID}) {
+		t.Errorf("lock holders, got: %v, expected: [%d]", got, holder.GID)
+	}
+
+	holder.OnMuUnlock(nil, mu)
+	<-doneCh
+
+	if opCtxs = pendingOf(gid); len(opCtxs) != 0 {
+		t.Errorf("expected no pending ops, got: %+v", opCtxs)
+	}
+}
+
+func TestMutexDropsLeftoverOps(t *testing.T) {
+	mu := &sync.Mutex{}
+	testKeepAlive = append(testKeepAlive, mu)
+	ch := newTestChan(false)
+
+	// A send that a recovered panic left pending.
+	gctx := &GCtx{GID: 104}
+	gctx.OnChanSend(nil, ch)
+
+	gctx.OnMuLock(nil, mu)
+
+	if len(gctx.OpCtxs) != 0 || len(pendingOf(gctx.GID)) != 0 {
+		t.Errorf("expected no pending ops, got: %+v", gctx.OpCtxs)
+	}
+	if info, _ := DefaultChanRegistry.Lookup(mu); info.Holder != gctx.GID {
+		t.Errorf("holder, got: %d, expected: %d", info.Holder, gctx.GID)
+	}
+
+	gctx.OnMuUnlock(nil, mu)
+}
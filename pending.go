@@ -0,0 +1,143 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// PendingOps is a copy of the pending operations of a GCtx, which
+// other goroutines may safely inspect.
+type PendingOps struct {
+	GCtx   *GCtx // Only for identity; not safe to dereference.
+	GID    GID
+	OpCtxs []OpCtx
+}
+
+var DefaultPendingShards = 64
+
+// pending tracks every GCtx that has pending operations, sharded by
+// GCtx address to avoid a global lock.
+var pending = newPendingRegistry(DefaultPendingShards)
+
+type pendingRegistry struct {
+	shards []pendingShard
+}
+
+type pendingShard struct {
+	m     sync.Mutex
+	gctxs map[*GCtx]*PendingOps
+}
+
+func newPendingRegistry(numShards int) *pendingRegistry {
+	if numShards <= 0 {
+		numShards = 1
+	}
+	r := &pendingRegistry{shards: make([]pendingShard, numShards)}
+	for i := range r.shards {
+		r.shards[i].gctxs = map[*GCtx]*PendingOps{}
+	}
+	return r
+}
+
+func (r *pendingRegistry) shard(gctx *GCtx) *pendingShard {
+	h := uint64(uintptr(unsafe.Pointer(gctx))>>4) * 0x9E3779B97F4A7C15
+	return &r.shards[(h>>32)%uint64(len(r.shards))]
+}
+
+// set records a copy of the current pending operations of a GCtx,
+// except those that are not sampled, or forgets the GCtx if it has
+// no sampled pending operations.
+func (r *pendingRegistry) set(gctx *GCtx) {
+	p := &PendingOps{
+		GCtx: gctx,
+		GID:  gctx.GID,
+	}
+	for _, opCtx := range gctx.OpCtxs {
+		if opCtx.Sampled {
+			p.OpCtxs = append(p.OpCtxs, opCtx)
+		}
+	}
+	if len(p.OpCtxs) <= 0 {
+		r.del(gctx)
+		return
+	}
+
+	s := r.shard(gctx)
+	s.m.Lock()
+	s.gctxs[gctx] = p
+	s.m.Unlock()
+}
+
+// del forgets a GCtx, which no longer has pending operations.
+func (r *pendingRegistry) del(gctx *GCtx) {
+	s := r.shard(gctx)
+	s.m.Lock()
+	delete(s.gctxs, gctx)
+	s.m.Unlock()
+}
+
+// all returns every PendingOps, locking one shard at a time.  As a
+// PendingOps is replaced rather than modified by set(), the caller
+// may inspect them, ex: symbolize their stacks, without holding up
+// the operations of other goroutines.  The caller must not modify
+// the PendingOps.
+func (r *pendingRegistry) all() []*PendingOps {
+	var rv []*PendingOps
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.m.Lock()
+		for _, p := range s.gctxs {
+			rv = append(rv, p)
+		}
+		s.m.Unlock()
+	}
+	return rv
+}
+
+// delGID forgets the GCtx's of a goroutine that exited, whose
+// operations were left pending by a panic.
+func (r *pendingRegistry) delGID(gid GID) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.m.Lock()
+		for gctx, p := range s.gctxs {
+			if p.GID == gid {
+				delete(s.gctxs, gctx)
+			}
+		}
+		s.m.Unlock()
+	}
+}
+
+// snapshot returns every PendingOps, with every shard locked at once
+// so that they're consistent with each other.  Like all(), the shards
+// are unlocked before the caller inspects them.
+func (r *pendingRegistry) snapshot() []*PendingOps {
+	for i := range r.shards {
+		r.shards[i].m.Lock()
+	}
+
+	var rv []*PendingOps
+	for i := range r.shards {
+		for _, p := range r.shards[i].gctxs {
+			rv = append(rv, p)
+		}
+	}
+
+	for i := len(r.shards) - 1; i >= 0; i-- {
+		r.shards[i].m.Unlock()
+	}
+
+	return rv
+}
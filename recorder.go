@@ -0,0 +1,291 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind distinguishes the beginning and end of an operation, and
+// the start and exit of a spawned goroutine.
+type EventKind int
+
+const (
+	EVENT_BEGIN EventKind = iota
+	EVENT_END
+	EVENT_SPAWN
+	EVENT_EXIT
+)
+
+var EventKindStrings = map[EventKind]string{
+	EVENT_BEGIN: "begin",
+	EVENT_END:   "end",
+	EVENT_SPAWN: "spawn",
+	EVENT_EXIT:  "exit",
+}
+
+// Event is a timestamped record of an operation by a goroutine.
+type Event struct {
+	Kind    EventKind
+	TS      int64 // Nanoseconds since the recorder started (monotonic).
+	GID     GID
+	Op      Op
+	CaseNum int    // The select case position, or -1.
+	ChanID  ChanID // The target channel or mutex, or 0.
+	Len     int    // The target channel's sampled len().
+	Cap     int    // The target channel's cap().
+	Stack   StackID
+
+	// Completed is true on an EVENT_END when the operation actually
+	// happened, as opposed to a select case that was not chosen.
+	Completed bool
+
+	// Value is the encoded message of a completed send or receive,
+	// when a ValueEncoder is set.
+	Value string
+
+	// Closed is true on the EVENT_END of a receive that returned
+	// because the channel was closed, rather than with a message.
+	Closed bool
+
+	// Parent, Func and Name are the spawning goroutine, the function
+	// and the name of the goroutine of an EVENT_SPAWN, whose Stack is
+	// where the go statement was executed.
+	Parent GID
+	Func   string
+	Name   string
+
+	// Panicked is true on an EVENT_EXIT when the goroutine did not
+	// return normally, ex: it panicked.
+	Panicked bool
+
+	// Holder is the goroutine that held the target mutex's (write)
+	// lock, on the EVENT_BEGIN of a lock operation, or 0 if unknown.
+	Holder GID
+}
+
+// EventSink is notified of every event recorded by a Recorder.
+type EventSink interface {
+	OnEvent(e *Event)
+}
+
+// ---------------------------------------------------------------
+
+var DefaultRecorderMaxEvents = 100000
+
+// DefaultRecorder is the process-wide Recorder that GCtx's use.
+var DefaultRecorder = NewRecorder(DefaultRecorderMaxEvents)
+
+// A Recorder turns operations into timestamped events, keeping the
+// most recent events in memory and passing every event to its sinks.
+type Recorder struct {
+	start time.Time
+
+	policy atomic.Value // Holds a samplePolicyRef.
+
+	m         sync.Mutex // Protects the fields that follow.
+	events    []Event    // Ring buffer of the most recent events.
+	maxEvents int        // The events are grown lazily up to maxEvents.
+	next      int        // Position in events of the next Record().
+	total     uint64     // Count of events ever recorded.
+	sinks     []EventSink
+	queue     []Event // Recorded events not yet passed to the sinks.
+
+	// dispatching is held by the goroutine that passes the queued
+	// events to the sinks, so that the sinks see them in order.
+	dispatching sync.Mutex
+}
+
+// NewRecorder returns a Recorder that remembers up to maxEvents of
+// the most recent events.
+func NewRecorder(maxEvents int) *Recorder {
+	return &Recorder{
+		start:     time.Now(),
+		maxEvents: maxEvents,
+	}
+}
+
+// Now returns the current recorder timestamp, which is based on the
+// monotonic clock.
+func (r *Recorder) Now() int64 {
+	return int64(time.Since(r.start))
+}
+
+// Start returns the wall clock time of recorder timestamp 0.
+func (r *Recorder) Start() time.Time {
+	return r.start
+}
+
+// Record assigns a timestamp to the event, remembers it and passes
+// it to the sinks.  The returned timestamp is never smaller than the
+// timestamp of any previously recorded event.
+func (r *Recorder) Record(e *Event) int64 {
+	r.m.Lock()
+
+	e.TS = r.Now()
+
+	queued := r.record(e)
+
+	r.m.Unlock()
+
+	if queued {
+		r.dispatch()
+	}
+
+	return e.TS
+}
+
+// RecordDeferred is like Record, but keeps the event's timestamp,
+// such as for a begin event that's recorded only after its operation
+// ended, so sinks might see it out of timestamp order.
+func (r *Recorder) RecordDeferred(e *Event) {
+	r.m.Lock()
+	queued := r.record(e)
+	r.m.Unlock()
+
+	if queued {
+		r.dispatch()
+	}
+}
+
+// record remembers the event while the recorder is locked, and
+// returns true if the event was queued for the sinks.
+func (r *Recorder) record(e *Event) bool {
+	if r.maxEvents > 0 {
+		if len(r.events) < r.maxEvents {
+			r.events = append(r.events, *e)
+		} else {
+			r.events[r.next] = *e
+		}
+		r.next = (r.next + 1) % r.maxEvents
+	}
+
+	r.total++
+
+	if len(r.sinks) <= 0 {
+		return false
+	}
+
+	r.queue = append(r.queue, *e)
+
+	return true
+}
+
+// dispatch passes the queued events to the sinks after the recorder
+// is unlocked, so that a sink's I/O does not block the recording of
+// events.  Only one goroutine dispatches at a time, which keeps the
+// events in order, and a goroutine that finds another goroutine
+// dispatching leaves its events to that goroutine.
+func (r *Recorder) dispatch() {
+	for r.dispatching.TryLock() {
+		for {
+			r.m.Lock()
+			events, sinks := r.queue, r.sinks
+			r.queue = nil
+			r.m.Unlock()
+
+			if len(events) <= 0 {
+				break
+			}
+
+			for i := range events {
+				for _, sink := range sinks {
+					sink.OnEvent(&events[i])
+				}
+			}
+		}
+
+		r.dispatching.Unlock()
+
+		// Events that were queued just before the unlock would
+		// otherwise wait for the next Record().
+		r.m.Lock()
+		more := len(r.queue) > 0
+		r.m.Unlock()
+
+		if !more {
+			return
+		}
+	}
+}
+
+// Events returns a copy of the remembered events, oldest first.
+func (r *Recorder) Events() []Event {
+	r.m.Lock()
+	rv := make([]Event, 0, len(r.events))
+	if len(r.events) < r.maxEvents {
+		rv = append(rv, r.events...)
+	} else {
+		rv = append(rv, r.events[r.next:]...)
+		rv = append(rv, r.events[:r.next]...)
+	}
+	r.m.Unlock()
+
+	return rv
+}
+
+// Total returns the count of events ever recorded, including those
+// no longer remembered.
+func (r *Recorder) Total() uint64 {
+	r.m.Lock()
+	rv := r.total
+	r.m.Unlock()
+
+	return rv
+}
+
+// Reset forgets the remembered events.
+func (r *Recorder) Reset() {
+	r.m.Lock()
+	r.events = r.events[:0]
+	r.next = 0
+	r.m.Unlock()
+}
+
+// AddSink registers a sink to be notified of every event.  Sinks
+// are invoked after the recorder is unlocked, but one event at a time
+// and in the order that the events were recorded, so they see events
+// in timestamp order, except for RecordDeferred() events.
+func (r *Recorder) AddSink(sink EventSink) {
+	r.m.Lock()
+	r.sinks = append(r.sinks, sink)
+	r.m.Unlock()
+}
+
+// Sinks returns a copy of the registered sinks.
+func (r *Recorder) Sinks() []EventSink {
+	r.m.Lock()
+	rv := append([]EventSink(nil), r.sinks...)
+	r.m.Unlock()
+
+	return rv
+}
+
+// RemoveSink unregisters a previously added sink, waiting for any
+// events that are being passed to the sinks, so that the sink is not
+// notified once RemoveSink returns.  It must not be invoked by a sink.
+func (r *Recorder) RemoveSink(sink EventSink) {
+	r.m.Lock()
+	sinks := make([]EventSink, 0, len(r.sinks))
+	for _, s := range r.sinks {
+		if s != sink {
+			sinks = append(sinks, s)
+		}
+	}
+	r.sinks = sinks
+	r.m.Unlock()
+
+	r.dispatching.Lock()
+	r.dispatching.Unlock()
+}
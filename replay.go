@@ -0,0 +1,368 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// A Replay drives an instrumented program with a previous recording
+// of it, so that a rare interleaving can be reproduced on demand.
+//
+// Every select is forced to choose the same case as it did in the
+// recording, by handing nil channels to its other cases.  The n'th
+// select executed at a call site is matched with the n'th select that
+// was recorded at that call site.
+//
+// Sends on a channel are serialized into their recorded order, where
+// a send waits until the sends that were recorded before it, from
+// other call sites, have completed.  Channels are matched by ChanID,
+// so they need to be first used in the same order as the recording.
+//
+// Replay is best effort: a send that waits longer than the Timeout
+// proceeds anyway, and a forced select case that's not ready can't be
+// forced if the select has a default case.  Such mismatches are
+// counted as Divergences.  The recording must not have been sampled.
+type Replay struct {
+	// Timeout is how long a send waits for its recorded turn.
+	Timeout time.Duration
+
+	m       sync.Mutex           // Protects the fields that follow.
+	selects map[string][]int     // Keyed by site, the chosen case nums in order.
+	sends   map[ChanID][]string  // Keyed by chan, the send sites in order.
+	waiting map[ChanID]chan bool // Closed when a chan's send order advances.
+
+	divergences int64 // Accessed via atomic.
+}
+
+// DefaultReplayTimeout is how long a send waits for its recorded turn.
+var DefaultReplayTimeout = time.Second
+
+// REPLAY_DEFAULT is the choice of a select that took its default case.
+const REPLAY_DEFAULT = -1
+
+var replay atomic.Value // Holds a replayRef.
+
+// replayRef allows atomic.Value to hold a nil Replay.
+type replayRef struct {
+	rp *Replay
+}
+
+// StartReplay makes the instrumented code follow the Replay, until
+// StopReplay() is called.
+func StartReplay(rp *Replay) {
+	replay.Store(replayRef{rp})
+}
+
+// StopReplay stops following the current Replay, if any.
+func StopReplay() {
+	replay.Store(replayRef{})
+}
+
+// CurrentReplay returns the Replay being followed, or nil.
+func CurrentReplay() *Replay {
+	ref, _ := replay.Load().(replayRef)
+	return ref.rp
+}
+
+// ---------------------------------------------------------------
+
+// LoadReplay reads a recording into a Replay.
+func LoadReplay(r *trace.Reader) (*Replay, error) {
+	rp := &Replay{
+		Timeout: DefaultReplayTimeout,
+		selects: map[string][]int{},
+		sends:   map[ChanID][]string{},
+		waiting: map[ChanID]chan bool{},
+	}
+
+	type selectInstance struct {
+		site    string
+		begin   int64
+		pending int // Count of case ops that have not ended.
+		chosen  int
+	}
+
+	var instances []*selectInstance
+
+	current := map[int64]*selectInstance{} // Keyed by gid.
+
+	opSelectSend := OpStrings[OP_CH_SELECT_SEND]
+	opSelectRecv := OpStrings[OP_CH_SELECT_RECV]
+	opSend := OpStrings[OP_CH_SEND]
+
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		opName := r.OpName(e.Op)
+
+		if opName == opSelectSend || opName == opSelectRecv {
+			s := current[e.GID]
+
+			if e.Kind == trace.KIND_BEGIN {
+				if s == nil {
+					s = &selectInstance{
+						site:   ReplaySite(r.Stack(e.StackID).Text),
+						begin:  e.TS,
+						chosen: REPLAY_DEFAULT,
+					}
+					current[e.GID] = s
+					instances = append(instances, s)
+				}
+				s.pending++
+			} else if s != nil {
+				if e.Completed {
+					s.chosen = e.CaseNum
+				}
+				s.pending--
+				if s.pending <= 0 {
+					delete(current, e.GID)
+				}
+			}
+		}
+
+		if (opName == opSend || opName == opSelectSend) &&
+			e.Kind == trace.KIND_END && e.Completed {
+			chanID := ChanID(e.ChanID)
+			rp.sends[chanID] = append(rp.sends[chanID],
+				ReplaySite(r.Stack(e.StackID).Text))
+		}
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].begin < instances[j].begin
+	})
+
+	for _, s := range instances {
+		rp.selects[s.site] = append(rp.selects[s.site], s.chosen)
+	}
+
+	return rp, nil
+}
+
+// ReplaySite returns the identity of a call site from the text of a
+// stack, which is the function and file:line of its innermost frame.
+func ReplaySite(stackText string) string {
+	lines := strings.SplitN(stackText, "\n", 3)
+	if len(lines) < 2 {
+		return stackText
+	}
+	fileLine := strings.TrimSpace(lines[1])
+	if sp := strings.LastIndex(fileLine, " +0x"); sp >= 0 {
+		fileLine = fileLine[:sp]
+	}
+	return lines[0] + " " + fileLine
+}
+
+// Divergences returns how many times the program did not follow the
+// recording.
+func (rp *Replay) Divergences() int64 {
+	return atomic.LoadInt64(&rp.divergences)
+}
+
+func (rp *Replay) diverged() {
+	atomic.AddInt64(&rp.divergences, 1)
+}
+
+// ---------------------------------------------------------------
+
+// nextSelect returns the recorded choice of the next select at a
+// call site, where ok is false if the recording has no more selects
+// at that site.
+func (rp *Replay) nextSelect(site string) (choice int, ok bool) {
+	rp.m.Lock()
+	defer rp.m.Unlock()
+
+	choices := rp.selects[site]
+	if len(choices) <= 0 {
+		return 0, false
+	}
+	rp.selects[site] = choices[1:]
+
+	return choices[0], true
+}
+
+// awaitSend blocks until it's the turn of a send from the call site,
+// or until the Timeout.
+func (rp *Replay) awaitSend(chanID ChanID, site string) {
+	deadline := time.Now().Add(rp.Timeout)
+
+	rp.m.Lock()
+	for {
+		order := rp.sends[chanID]
+		if len(order) <= 0 || order[0] == site || !containsString(order, site) {
+			break
+		}
+
+		wait := rp.waiting[chanID]
+		if wait == nil {
+			wait = make(chan bool)
+			rp.waiting[chanID] = wait
+		}
+		rp.m.Unlock()
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			rp.diverged()
+			return
+		}
+
+		select {
+		case <-wait:
+		case <-time.After(remaining):
+		}
+
+		rp.m.Lock()
+	}
+	rp.m.Unlock()
+}
+
+// sent advances the send order of a channel past a completed send.
+func (rp *Replay) sent(chanID ChanID, site string) {
+	rp.m.Lock()
+	defer rp.m.Unlock()
+
+	order := rp.sends[chanID]
+	if len(order) <= 0 {
+		return
+	}
+
+	i := indexString(order, site)
+	if i < 0 {
+		rp.diverged()
+		return
+	}
+	if i > 0 { // Out of order, ex: after a timeout.
+		rp.diverged()
+	}
+	rp.sends[chanID] = append(order[:i:i], order[i+1:]...)
+
+	if wait := rp.waiting[chanID]; wait != nil {
+		close(wait)
+		delete(rp.waiting, chanID)
+	}
+}
+
+func indexString(a []string, s string) int {
+	for i, x := range a {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsString(a []string, s string) bool {
+	return indexString(a, s) >= 0
+}
+
+// ---------------------------------------------------------------
+
+// replaySelectCase returns the channel that a select case should use,
+// which is a nil channel of the same type if the recording chose a
+// different case.  It's invoked after the case's op was added.
+func (gctx *GCtx) replaySelectCase(caseNum int, ch interface{}) interface{} {
+	rp := CurrentReplay()
+	if rp == nil {
+		return ch
+	}
+
+	if len(gctx.OpCtxs) == 1 { // The first case of a select.
+		gctx.replayChoice, gctx.replayForced =
+			rp.nextSelect(ReplaySite(gctx.OpCtxs[0].Stack.Text()))
+	}
+
+	if !gctx.replayForced || gctx.replayChoice == caseNum || ch == nil {
+		return ch
+	}
+
+	return reflect.Zero(reflect.TypeOf(ch)).Interface()
+}
+
+// replaySelectDone checks that a select chose the recorded case.
+func (gctx *GCtx) replaySelectDone(caseNum int) {
+	if gctx.replayForced && gctx.replayChoice != caseNum {
+		if rp := CurrentReplay(); rp != nil {
+			rp.diverged()
+		}
+	}
+	gctx.replayForced = false
+}
+
+// replaySend waits for the recorded turn of a send.
+func (gctx *GCtx) replaySend() {
+	rp := CurrentReplay()
+	if rp == nil || len(gctx.OpCtxs) <= 0 {
+		return
+	}
+
+	opCtx := &gctx.OpCtxs[len(gctx.OpCtxs)-1]
+	if opCtx.ChanID != 0 && opCtx.Stack != 0 {
+		rp.awaitSend(opCtx.ChanID, ReplaySite(opCtx.Stack.Text()))
+	}
+}
+
+// replaySent advances the recorded send order past a completed send.
+func replaySent(opCtx *OpCtx) {
+	rp := CurrentReplay()
+	if rp != nil && opCtx.ChanID != 0 && opCtx.Stack != 0 {
+		rp.sent(opCtx.ChanID, ReplaySite(opCtx.Stack.Text()))
+	}
+}
+
+// ---------------------------------------------------------------
+
+// EnvReplay is the environment variable of a recording to replay
+// when the process starts, ex: GAPTURE_REPLAY=/tmp/out.gap.
+var EnvReplay = "GAPTURE_REPLAY"
+
+func init() {
+	path := os.Getenv(EnvReplay)
+	if path == "" {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("gapture: could not open %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+
+	r, err := trace.NewReader(f)
+	if err == nil {
+		var rp *Replay
+		rp, err = LoadReplay(r)
+		if err == nil {
+			StartReplay(rp)
+			return
+		}
+	}
+
+	log.Printf("gapture: could not load replay %s: %v", path, err)
+}
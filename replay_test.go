@@ -0,0 +1,152 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// selectEither is an instrumented select of two ready channels, so
+// that the runtime chooses either case at random.
+func selectEither(gctx *GCtx, a, b chan int) int {
+	select {
+	case <-gctx.OnChanSelectRecv(nil, 0, a).(chan int):
+		gctx.OnChanSelectRecvDone(0)
+		return 0
+	case <-gctx.OnChanSelectRecv(nil, 1, b).(chan int):
+		gctx.OnChanSelectRecvDone(1)
+		return 1
+	}
+}
+
+func sendFirst(gctx *GCtx, ch chan int) {
+	gctx.OnChanSend(nil, ch).(chan int) <- gctx.OnChanSendValue(1).(int)
+	gctx.OnChanSendDone()
+}
+
+func sendSecond(gctx *GCtx, ch chan int) {
+	gctx.OnChanSend(nil, ch).(chan int) <- gctx.OnChanSendValue(2).(int)
+	gctx.OnChanSendDone()
+}
+
+// recordReplay records f into a trace, and returns the trace loaded
+// as a Replay.
+func recordReplay(t *testing.T, f func()) *Replay {
+	var buf bytes.Buffer
+
+	s, err := StartTrace(&buf)
+	if err != nil {
+		t.Fatalf("StartTrace, err: %v", err)
+	}
+	f()
+	if err = s.Stop(); err != nil {
+		t.Fatalf("Stop, err: %v", err)
+	}
+
+	r, err := trace.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+	rp, err := LoadReplay(r)
+	if err != nil {
+		t.Fatalf("LoadReplay, err: %v", err)
+	}
+	return rp
+}
+
+func TestReplaySelects(t *testing.T) {
+	run := func() []int {
+		var gctx GCtx
+		var rv []int
+		for i := 0; i < 20; i++ {
+			a, b := make(chan int, 1), make(chan int, 1)
+			a <- 1
+			b <- 1
+			rv = append(rv, selectEither(&gctx, a, b))
+		}
+		return rv
+	}
+
+	var recorded []int
+	rp := recordReplay(t, func() { recorded = run() })
+
+	StartReplay(rp)
+	defer StopReplay()
+
+	replayed := run()
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("choices, got: %v, expected: %v", replayed, recorded)
+	}
+	if n := rp.Divergences(); n != 0 {
+		t.Errorf("divergences, got: %d", n)
+	}
+}
+
+func TestReplaySendOrder(t *testing.T) {
+	ch := make(chan int, 2)
+	testKeepAlive = append(testKeepAlive, ch)
+
+	var gctx GCtx
+
+	rp := recordReplay(t, func() {
+		sendSecond(&gctx, ch)
+		sendFirst(&gctx, ch)
+		<-ch
+		<-ch
+	})
+	rp.Timeout = 10 * time.Second
+
+	StartReplay(rp)
+	defer StopReplay()
+
+	// The first send now starts first, but waits for its turn.
+	doneCh := make(chan struct{})
+	go func() {
+		var gctx GCtx
+		sendFirst(&gctx, ch)
+		close(doneCh)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sendSecond(&gctx, ch)
+	<-doneCh
+
+	if got := []int{<-ch, <-ch}; !reflect.DeepEqual(got, []int{2, 1}) {
+		t.Errorf("order, got: %v, expected: [2 1]", got)
+	}
+	if n := rp.Divergences(); n != 0 {
+		t.Errorf("divergences, got: %d", n)
+	}
+}
+
+func TestReplaySite(t *testing.T) {
+	tests := []struct {
+		stack    string
+		expected string
+	}{
+		{"main.worker(...)\n\t/src/main.go:30 +0x1d\nmain.main()\n",
+			"main.worker(...) /src/main.go:30"},
+		{"main.worker(...)\n\t/src/main.go:30\n", "main.worker(...) /src/main.go:30"},
+		{"main.worker(...)", "main.worker(...)"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := ReplaySite(test.stack); got != test.expected {
+			t.Errorf("%q, got: %q, expected: %q", test.stack, got, test.expected)
+		}
+	}
+}
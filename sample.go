@@ -0,0 +1,111 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"regexp"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A SamplePolicy decides which operations a Recorder records, so
+// that the overhead can be bounded, ex: for production canaries.  An
+// operation is recorded only when it passes every configured filter.
+//
+// Operations that are filtered out take a fast path, which skips the
+// stack capture, the channel registry (unless ChanName is used) and
+// the events, so they're also invisible to the stall watchdog,
+// FindDeadlocks() and Snapshot().
+//
+// A SamplePolicy must not be modified or copied after it's been
+// passed to SetSamplePolicy().
+type SamplePolicy struct {
+	// Ops, when non-empty, limits recording to these Op kinds.
+	Ops map[Op]bool
+
+	// ChanName, when non-nil, limits recording to operations on
+	// channels whose registered name matches.  Unnamed channels
+	// never match.
+	ChanName *regexp.Regexp
+
+	// EveryN, when greater than 1, records only 1 in N of the
+	// operations of each call site, starting with the first.
+	EveryN uint64
+
+	// MinBlocked, when positive, records only operations that take at
+	// least this long.  Their begin events are deferred until the
+	// operation ends, so they're recorded out of timestamp order.
+	MinBlocked time.Duration
+
+	sites sync.Map // Keyed by call site PC, value is *uint64 count.
+	names sync.Map // Keyed by channel name, value is ChanName match bool.
+}
+
+// SetSamplePolicy changes which operations are recorded, where a nil
+// policy records every operation.
+func (r *Recorder) SetSamplePolicy(p *SamplePolicy) {
+	r.policy.Store(samplePolicyRef{p})
+}
+
+// SamplePolicy returns the current SamplePolicy, or nil.
+func (r *Recorder) SamplePolicy() *SamplePolicy {
+	ref, _ := r.policy.Load().(samplePolicyRef)
+	return ref.p
+}
+
+// samplePolicyRef allows atomic.Value to hold a nil policy.
+type samplePolicyRef struct {
+	p *SamplePolicy
+}
+
+// sample decides whether to record an operation, and whether its
+// begin event is deferred until it ends.  The call site is found by
+// skipping sample itself and the given number of its callers' frames.
+func (p *SamplePolicy) sample(op Op, site *Site, target interface{},
+	skipFrames int) (record, deferred bool) {
+	if len(p.Ops) > 0 && !p.Ops[op] {
+		return false, false
+	}
+
+	if p.ChanName != nil {
+		info, _ := DefaultChanRegistry.ObserveSite(target, site)
+		if info.Name == "" || !p.matchName(info.Name) {
+			return false, false
+		}
+	}
+
+	if p.EveryN > 1 {
+		var pcs [1]uintptr
+		runtime.Callers(skipFrames+2, pcs[:])
+
+		v, exists := p.sites.Load(pcs[0])
+		if !exists {
+			v, _ = p.sites.LoadOrStore(pcs[0], new(uint64))
+		}
+		if (atomic.AddUint64(v.(*uint64), 1)-1)%p.EveryN != 0 {
+			return false, false
+		}
+	}
+
+	return true, p.MinBlocked > 0
+}
+
+func (p *SamplePolicy) matchName(name string) bool {
+	if v, exists := p.names.Load(name); exists {
+		return v.(bool)
+	}
+	matched := p.ChanName.MatchString(name)
+	p.names.Store(name, matched)
+	return matched
+}
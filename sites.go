@@ -0,0 +1,107 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Site is a static descriptor of an instrumented channel operation,
+// which the Converter declares as a package level var and passes to
+// the On* hooks, so that channels are named after the source
+// expressions that use them.
+type Site struct {
+	Expr string // The channel's source expression, ex: "msg.ReplyCh".
+	Pos  string // The "file.go:line" of the operation.
+
+	// Decl is the "file.go:line" where the var or field of the
+	// expression was declared, or "" if unknown.
+	Decl string
+}
+
+// ChanName returns the display name of a registered channel, mutex or
+// WaitGroup, ex: "subtasks (subworkers.go:42)", or "chan #N" (or
+// "sync.Mutex #N") when it has no name, followed by where an unnamed
+// channel was made, if known.  Tags are shown in braces, ex:
+// "ingest.requests{shard=3} (ingest.go:20)".
+func ChanName(id ChanID) string {
+	info, ok := DefaultChanRegistry.LookupID(id)
+	if !ok {
+		return fmt.Sprintf("chan #%d", id)
+	}
+	name := info.Name
+	if name == "" && SyncTypeNames[info.Type] {
+		name = fmt.Sprintf("%s #%d", info.Type, id)
+	} else if name == "" {
+		name = fmt.Sprintf("chan #%d", id)
+	}
+	if len(info.Tags) > 0 {
+		name += "{" + info.Tags.String() + "}"
+	}
+	if info.Site == "" {
+		return name
+	}
+	return name + " (" + info.Site + ")"
+}
+
+// ---------------------------------------------------------------
+
+// Tags are metadata about a channel, ex: gapture.Tags{"shard": "3"}.
+type Tags map[string]string
+
+// String returns the tags ordered by key, ex: "shard=3,zone=b".
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+t[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t Tags) copy() Tags {
+	rv := make(Tags, len(t))
+	for k, v := range t {
+		rv[k] = v
+	}
+	return rv
+}
+
+// NameChan gives a channel an explicit name and optional tags, ex:
+//
+//	gapture.NameChan(ch, "ingest.requests", gapture.Tags{"shard": "3"})
+//
+// which takes precedence over the names that are inferred from the
+// instrumented source code.  It's useful for channels that are made by
+// generic helpers, and works whether or not the calling file was
+// instrumented.  A name of "" keeps the current name, and nil tags
+// keep the current tags.  Traces that are being streamed are updated.
+func NameChan(ch interface{}, name string, tags Tags) {
+	info, ok := DefaultChanRegistry.SetNameTags(ch, name,
+		CaptureStack(1).Site(), tags)
+	if !ok {
+		return
+	}
+
+	for _, sink := range DefaultRecorder.Sinks() {
+		if s, ok := sink.(*TraceSink); ok {
+			s.WriteChan(info)
+		}
+	}
+}
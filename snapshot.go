@@ -0,0 +1,128 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sort"
+	"time"
+)
+
+// SnapshotView is a consistent view of every in-flight operation.
+type SnapshotView struct {
+	TS         int64 // Recorder timestamp of the snapshot.
+	Goroutines []GoroutineView
+}
+
+// GoroutineView is a goroutine with in-flight operations.
+type GoroutineView struct {
+	GID  GID
+	Name string   // See GoroutineName().
+	Ops  []OpView // More than one while evaluating or blocked in a select.
+}
+
+// OpView is an in-flight operation and its target channel, mutex or
+// WaitGroup.
+type OpView struct {
+	Op      Op
+	CaseNum int // The select case position, or -1.
+	Chan    ChanInfo
+	Blocked time.Duration
+	Stack   string
+
+	// Senders and Receivers are the other goroutines that most
+	// recently sent to or received from the channel, most recent
+	// last.
+	Senders   []Toucher
+	Receivers []Toucher
+
+	// Holders are the goroutines that hold the lock that a lock
+	// operation waits for, if known.
+	Holders []GID
+
+	// Adders are the goroutines that owe a Done() to the WaitGroup
+	// that a Wait() waits for, if known, whose counter is Chan.Len.
+	Adders []Adder
+}
+
+// Snapshot returns a consistent view of every goroutine that has
+// in-flight operations, ordered by GID, including what it's blocked
+// on and which other goroutines last touched the same channels.
+func Snapshot() *SnapshotView {
+	entries := pending.snapshot()
+
+	rv := &SnapshotView{TS: DefaultRecorder.Now()}
+
+	byGID := map[GID]*GoroutineView{}
+
+	// The names, stacks and channels are looked up after the pending
+	// registry is unlocked, so other goroutines' operations proceed.
+	for _, p := range entries {
+		g := byGID[p.GID]
+		if g == nil {
+			g = &GoroutineView{GID: p.GID, Name: GoroutineName(p.GID)}
+			byGID[p.GID] = g
+		}
+
+		for _, opCtx := range p.OpCtxs {
+			op := OpView{
+				Op:      opCtx.Op,
+				CaseNum: opCtx.CaseNum,
+				Blocked: time.Duration(rv.TS - opCtx.Begin),
+				Stack:   opCtx.Stack.Text(),
+			}
+
+			op.Chan, _ = DefaultChanRegistry.Lookup(opCtx.Target)
+
+			senders, receivers := DefaultChanRegistry.Touchers(opCtx.Target)
+			op.Senders = withoutGID(senders, p.GID)
+			op.Receivers = withoutGID(receivers, p.GID)
+
+			if IsLockOp(opCtx.Op) {
+				op.Holders = lockHolders(opCtx)
+			} else if opCtx.Op == OP_WG_WAIT {
+				op.Adders = waitGroupAdders(opCtx)
+			}
+
+			g.Ops = append(g.Ops, op)
+		}
+	}
+
+	for _, g := range byGID {
+		rv.Goroutines = append(rv.Goroutines, *g)
+	}
+	sort.Slice(rv.Goroutines, func(i, j int) bool {
+		return rv.Goroutines[i].GID < rv.Goroutines[j].GID
+	})
+
+	return rv
+}
+
+// Goroutine returns the view of a goroutine, or nil if the goroutine
+// has no in-flight operations.
+func (s *SnapshotView) Goroutine(gid GID) *GoroutineView {
+	for i := range s.Goroutines {
+		if s.Goroutines[i].GID == gid {
+			return &s.Goroutines[i]
+		}
+	}
+	return nil
+}
+
+func withoutGID(touchers []Toucher, gid GID) []Toucher {
+	rv := touchers[:0]
+	for _, t := range touchers {
+		if t.GID != gid {
+			rv = append(rv, t)
+		}
+	}
+	return rv
+}
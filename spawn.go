@@ -0,0 +1,136 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// OnGo is invoked by the parent goroutine when a go statement
+// evaluates its func value, ex: "go gaptureGCtx.OnGo(f).(func(int))(x)".
+// It returns a func of the same type as fn, which records a spawn
+// event when the child goroutine starts, and an exit event when fn
+// returns or panics.  The args of the go statement are still
+// evaluated by the parent.
+func (gctx *GCtx) OnGo(fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return fn // The go statement fails as usual.
+	}
+
+	if p := DefaultRecorder.SamplePolicy(); p != nil &&
+		len(p.Ops) > 0 && !p.Ops[OP_GO] {
+		return fn
+	}
+
+	gctx.EnsureGID()
+
+	s := &spawn{
+		parent:  gctx.GID,
+		stack:   CaptureStack(1),
+		name:    FuncName(fn),
+		fn:      v,
+		handOff: handOffs.reserve(gctx.GID),
+	}
+
+	return reflect.MakeFunc(v.Type(), s.run).Interface()
+}
+
+// FuncName returns the package qualified name of a func value, ex:
+// "main.worker", or "main.main.func1" for a func literal, or "".
+func FuncName(fn interface{}) string {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return ""
+	}
+	f := runtime.FuncForPC(v.Pointer())
+	if f == nil {
+		return ""
+	}
+	return strings.TrimSuffix(f.Name(), "-fm") // Ex: a method value.
+}
+
+// spawn is a goroutine that's been started by a go statement.
+type spawn struct {
+	parent GID
+	stack  StackID // Where the go statement was executed.
+	name   string
+	fn     reflect.Value
+
+	// handOff is the WaitGroup whose Adders entry of the parent the
+	// goroutine takes over, or nil.
+	handOff *sync.WaitGroup
+}
+
+// spawnRunFunc is the function name of spawn.run, which is the
+// outermost frame of interest in the stacks of spawned goroutines.
+var spawnRunFunc = FuncName((*spawn).run)
+
+// run is the body of the child goroutine.
+func (s *spawn) run(args []reflect.Value) []reflect.Value {
+	gid := CurrentGID()
+
+	info := addGoroutine(GoroutineInfo{
+		GID:    gid,
+		Parent: s.parent,
+		Func:   s.name,
+		Stack:  s.stack,
+	})
+
+	if s.handOff != nil {
+		DefaultChanRegistry.HandOff(s.handOff, s.parent, adderOf(gid))
+	}
+
+	DefaultRecorder.Record(&Event{
+		Kind:    EVENT_SPAWN,
+		GID:     gid,
+		Op:      OP_GO,
+		CaseNum: -1,
+		Stack:   s.stack,
+		Parent:  s.parent,
+		Func:    s.name,
+		Name:    info.Name,
+	})
+
+	returned := false
+
+	defer func() { // Not recovering, so a panic continues as usual.
+		DefaultRecorder.Record(&Event{
+			Kind:      EVENT_EXIT,
+			GID:       gid,
+			Op:        OP_GO,
+			CaseNum:   -1,
+			Stack:     s.stack,
+			Completed: returned,
+			Panicked:  !returned,
+		})
+
+		delGoroutine(gid)
+		if !returned {
+			pending.delGID(gid)
+		}
+	}()
+
+	var rv []reflect.Value
+	if s.fn.Type().IsVariadic() {
+		rv = s.fn.CallSlice(args)
+	} else {
+		rv = s.fn.Call(args)
+	}
+
+	returned = true
+
+	return rv
+}
@@ -0,0 +1,222 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// StackID identifies an interned call stack, where 0 means no stack.
+// Identical stacks share the same StackID, and are symbolized into
+// text only when first asked for, ex: when exported to a trace.
+type StackID uint64
+
+// DefaultStackDepth is the max number of frames that are captured.
+const DefaultStackDepth = 32
+
+const stackShardBits = 4
+
+// stacks interns the captured stacks, sharded by the hash of their
+// PC's so that the common case of a previously seen stack only takes
+// a shard's read lock.
+var stacks [1 << stackShardBits]stackShard
+
+type stackShard struct {
+	m       sync.RWMutex
+	byHash  map[uint64][]*stackEntry // Chained on hash collisions.
+	entries []*stackEntry            // Indexed by StackID >> stackShardBits.
+}
+
+type stackEntry struct {
+	id  StackID
+	pcs []uintptr
+
+	once sync.Once // Guards the lazily symbolized text, site and fn.
+	text string
+	site string
+	fn   string
+}
+
+// CaptureStack returns the interned StackID of the current call
+// stack, skipping CaptureStack itself and the given number of its
+// callers' frames.
+func CaptureStack(skipFrames int) StackID {
+	var pcs [DefaultStackDepth]uintptr
+	n := runtime.Callers(skipFrames+2, pcs[:])
+	if n <= 0 {
+		return 0
+	}
+	return InternStack(pcs[:n])
+}
+
+// InternStack returns the StackID of the PC's, interning a copy of
+// them if they have not been seen before.
+func InternStack(pcs []uintptr) StackID {
+	h := hashPCs(pcs)
+	si := h & (1<<stackShardBits - 1)
+	s := &stacks[si]
+
+	s.m.RLock()
+	id := s.find(h, pcs)
+	s.m.RUnlock()
+	if id != 0 {
+		return id
+	}
+
+	s.m.Lock()
+	id = s.find(h, pcs)
+	if id == 0 {
+		id = StackID(uint64(len(s.entries)+1)<<stackShardBits | si)
+		e := &stackEntry{id: id, pcs: append([]uintptr(nil), pcs...)}
+		if s.byHash == nil {
+			s.byHash = map[uint64][]*stackEntry{}
+		}
+		s.byHash[h] = append(s.byHash[h], e)
+		s.entries = append(s.entries, e)
+	}
+	s.m.Unlock()
+
+	return id
+}
+
+func (s *stackShard) find(h uint64, pcs []uintptr) StackID {
+	for _, e := range s.byHash[h] {
+		if equalPCs(e.pcs, pcs) {
+			return e.id
+		}
+	}
+	return 0
+}
+
+func hashPCs(pcs []uintptr) uint64 {
+	h := uint64(14695981039346656037) // FNV-1a.
+	for _, pc := range pcs {
+		h ^= uint64(pc)
+		h *= 1099511628211
+	}
+	return h
+}
+
+func equalPCs(a, b []uintptr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (id StackID) entry() *stackEntry {
+	if id == 0 {
+		return nil
+	}
+	s := &stacks[uint64(id)&(1<<stackShardBits-1)]
+	i := int(uint64(id)>>stackShardBits) - 1
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if i < 0 || i >= len(s.entries) {
+		return nil
+	}
+	return s.entries[i]
+}
+
+// PCs returns the program counters of the stack.
+func (id StackID) PCs() []uintptr {
+	if e := id.entry(); e != nil {
+		return e.pcs
+	}
+	return nil
+}
+
+// Text returns the symbolized stack, which looks like the output of
+// runtime.Stack() without the goroutine header, or "" if unknown.
+func (id StackID) Text() string {
+	if e := id.entry(); e != nil {
+		e.once.Do(e.symbolize)
+		return e.text
+	}
+	return ""
+}
+
+// Site returns the "file.go:line" of the innermost frame of the
+// stack, or "" if unknown.
+func (id StackID) Site() string {
+	if e := id.entry(); e != nil {
+		e.once.Do(e.symbolize)
+		return e.site
+	}
+	return ""
+}
+
+// Func returns the function of the innermost frame of the stack, ex:
+// "main.worker", or "" if unknown.
+func (id StackID) Func() string {
+	if e := id.entry(); e != nil {
+		e.once.Do(e.symbolize)
+		return e.fn
+	}
+	return ""
+}
+
+func (e *stackEntry) symbolize() {
+	var fs []runtime.Frame
+
+	frames := runtime.CallersFrames(e.pcs)
+	for {
+		f, more := frames.Next()
+
+		if f.Function == spawnRunFunc {
+			// The outer frames are the wrapper of a spawned goroutine,
+			// so the stack ends with the goroutine's own func.
+			for len(fs) > 0 &&
+				strings.HasPrefix(fs[len(fs)-1].Function, "reflect.") {
+				fs = fs[:len(fs)-1]
+			}
+			break
+		}
+
+		if f.Function != "runtime.goexit" && f.Function != "runtime.main" {
+			fs = append(fs, f)
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	var b bytes.Buffer
+
+	for _, f := range fs {
+		if e.site == "" {
+			e.site = fmt.Sprintf("%s:%d", filepath.Base(f.File), f.Line)
+			e.fn = f.Function
+		}
+
+		fmt.Fprintf(&b, "%s(...)\n\t%s:%d", f.Function, f.File, f.Line)
+		if f.Entry != 0 && f.PC >= f.Entry {
+			fmt.Fprintf(&b, " +0x%x", f.PC-f.Entry)
+		}
+		b.WriteByte('\n')
+	}
+
+	e.text = b.String()
+}
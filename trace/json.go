@@ -0,0 +1,267 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The JSON Lines format has one JSON object per line, where the
+// "rec" field is the record kind: "header", "op", "stack", "chan",
+// "meta", "goroutine" or "event".  Events refer to ops by name and to stacks and
+// channels by id.  It's larger than the binary format, but can be
+// processed with generic tools, ex: jq 'select(.rec == "event")'.
+
+var JSONMagic = "gapture"
+
+// jsonRecord is the union of the fields of every JSON record kind,
+// used for reading.  Missing fields are zero values.
+type jsonRecord struct {
+	Rec       string `json:"rec"`
+	Magic     string `json:"magic,omitempty"`
+	Version   uint64 `json:"version,omitempty"`
+	ID        int64  `json:"id,omitempty"`
+	Code      int    `json:"code,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Site      string `json:"site,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Cap       int    `json:"cap,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Val       string `json:"val,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	TS        int64  `json:"ts,omitempty"`
+	GID       int64  `json:"gid,omitempty"`
+	Op        string `json:"op,omitempty"`
+	CaseNum   int    `json:"case,omitempty"`
+	Chan      int64  `json:"chan,omitempty"`
+	Len       int    `json:"len,omitempty"`
+	Stack     uint64 `json:"stack,omitempty"`
+	Completed bool   `json:"completed,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Closed    bool   `json:"closed,omitempty"`
+	Parent    int64  `json:"parent,omitempty"`
+	Func      string `json:"func,omitempty"`
+	Panicked  bool   `json:"panicked,omitempty"`
+	Holder    int64  `json:"holder,omitempty"`
+
+	Aliases []string `json:"aliases,omitempty"`
+	Elem    string   `json:"elem,omitempty"`
+	Creator int64    `json:"creator,omitempty"`
+	Created uint64   `json:"created,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// jsonEvent is how an event is written, with every field present.
+type jsonEvent struct {
+	Rec       string `json:"rec"`
+	Kind      string `json:"kind"`
+	TS        int64  `json:"ts"`
+	GID       int64  `json:"gid"`
+	Op        string `json:"op"`
+	CaseNum   int    `json:"case"`
+	Chan      int64  `json:"chan"`
+	Len       int    `json:"len"`
+	Cap       int    `json:"cap"`
+	Site      string `json:"site"`
+	Stack     uint64 `json:"stack"`
+	Completed bool   `json:"completed"`
+	Value     string `json:"value,omitempty"`
+	Closed    bool   `json:"closed,omitempty"`
+	Panicked  bool   `json:"panicked,omitempty"`
+	Holder    int64  `json:"holder,omitempty"`
+}
+
+// ---------------------------------------------------------------
+
+// A JSONWriter appends records to a JSON Lines trace.  A JSONWriter
+// is not concurrency safe.
+type JSONWriter struct {
+	w     *bufio.Writer
+	enc   *json.Encoder
+	ops   map[int]string
+	sites map[uint64]string // Keyed by stack id.
+}
+
+// NewJSONWriter writes the trace header and returns a JSONWriter.
+func NewJSONWriter(w io.Writer) (*JSONWriter, error) {
+	bw := bufio.NewWriter(w)
+
+	jw := &JSONWriter{
+		w:     bw,
+		enc:   json.NewEncoder(bw),
+		ops:   map[int]string{},
+		sites: map[uint64]string{},
+	}
+
+	err := jw.enc.Encode(&jsonRecord{
+		Rec: "header", Magic: JSONMagic, Version: Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jw, nil
+}
+
+func (w *JSONWriter) WriteOp(op int, name string) error {
+	w.ops[op] = name
+	return w.enc.Encode(&jsonRecord{Rec: "op", Code: op, Name: name})
+}
+
+func (w *JSONWriter) WriteStack(s *Stack) error {
+	w.sites[s.ID] = s.Site
+	return w.enc.Encode(&jsonRecord{
+		Rec: "stack", ID: int64(s.ID), Text: s.Text, Site: s.Site,
+	})
+}
+
+func (w *JSONWriter) WriteChan(c *Chan) error {
+	return w.enc.Encode(&jsonRecord{
+		Rec: "chan", ID: c.ID, Type: c.Type, Cap: c.Cap,
+		Name: c.Name, Site: c.Site, Aliases: c.Aliases,
+		Elem: c.Elem, Creator: c.Creator, Created: c.CreatedStackID,
+		Tags: c.Tags,
+	})
+}
+
+func (w *JSONWriter) WriteMeta(key, val string) error {
+	return w.enc.Encode(&jsonRecord{Rec: "meta", Key: key, Val: val})
+}
+
+func (w *JSONWriter) WriteGoroutine(g *Goroutine) error {
+	return w.enc.Encode(&jsonRecord{
+		Rec: "goroutine", GID: g.GID, Parent: g.Parent, Func: g.Func,
+		Stack: g.StackID, Name: g.Name,
+	})
+}
+
+func (w *JSONWriter) WriteEvent(e *Event) error {
+	return w.enc.Encode(&jsonEvent{
+		Rec:       "event",
+		Kind:      KindStrings[e.Kind],
+		TS:        e.TS,
+		GID:       e.GID,
+		Op:        w.ops[e.Op],
+		CaseNum:   e.CaseNum,
+		Chan:      e.ChanID,
+		Len:       e.Len,
+		Cap:       e.Cap,
+		Site:      w.sites[e.StackID],
+		Stack:     e.StackID,
+		Completed: e.Completed,
+		Value:     e.Value,
+		Closed:    e.Closed,
+		Panicked:  e.Panicked,
+		Holder:    e.Holder,
+	})
+}
+
+func (w *JSONWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// ---------------------------------------------------------------
+
+func (r *Reader) readJSONHeader() error {
+	line, err := r.r.ReadBytes('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	var rec jsonRecord
+	err = json.Unmarshal(line, &rec)
+	if err != nil || rec.Rec != "header" || rec.Magic != JSONMagic {
+		return ErrBadMagic
+	}
+
+	r.Version = rec.Version
+	if r.Version > Version {
+		return fmt.Errorf("trace: unsupported version: %d", r.Version)
+	}
+
+	return nil
+}
+
+func (r *Reader) nextJSON() (*Event, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		var rec jsonRecord
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return nil, err
+		}
+
+		switch rec.Rec {
+		case "op":
+			r.Ops[rec.Code] = rec.Name
+			r.opCodes[rec.Name] = rec.Code
+
+		case "stack":
+			r.Stacks[uint64(rec.ID)] = &Stack{
+				ID: uint64(rec.ID), Text: rec.Text, Site: rec.Site,
+			}
+
+		case "chan":
+			r.Chans[rec.ID] = &Chan{
+				ID: rec.ID, Type: rec.Type, Cap: rec.Cap,
+				Name: rec.Name, Site: rec.Site, Aliases: rec.Aliases,
+				Elem: rec.Elem, Creator: rec.Creator, CreatedStackID: rec.Created,
+				Tags: rec.Tags,
+			}
+
+		case "meta":
+			r.Meta[rec.Key] = rec.Val
+
+		case "goroutine":
+			r.Goroutines[rec.GID] = &Goroutine{
+				GID: rec.GID, Parent: rec.Parent, Func: rec.Func,
+				StackID: rec.Stack, Name: rec.Name,
+			}
+
+		case "event":
+			e := &Event{
+				TS:        rec.TS,
+				GID:       rec.GID,
+				Op:        r.opCodes[rec.Op],
+				CaseNum:   rec.CaseNum,
+				ChanID:    rec.Chan,
+				Len:       rec.Len,
+				Cap:       rec.Cap,
+				StackID:   rec.Stack,
+				Completed: rec.Completed,
+				Value:     rec.Value,
+				Closed:    rec.Closed,
+				Panicked:  rec.Panicked,
+				Holder:    rec.Holder,
+			}
+			for kind, name := range KindStrings {
+				if rec.Kind == name {
+					e.Kind = kind
+				}
+			}
+
+			return e, nil
+		}
+	}
+}
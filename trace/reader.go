@@ -0,0 +1,230 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A Reader iterates the events of a trace, in either the binary or
+// the JSON Lines format, which is detected automatically.
+// Definitions of ops, stacks, channels, goroutines and metadata are
+// accumulated as they're read, so they're available for every event
+// returned by Next().
+type Reader struct {
+	r       *bufio.Reader
+	json    bool           // True for the JSON Lines format.
+	opCodes map[string]int // Only for the JSON Lines format.
+	payload []byte
+	lastTS  int64
+
+	Version uint64
+	Ops     map[int]string
+	Stacks  map[uint64]*Stack
+	Chans   map[int64]*Chan
+	Meta    map[string]string
+
+	Goroutines map[int64]*Goroutine
+}
+
+// NewReader reads the trace header and returns a Reader.
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := &Reader{
+		r:       bufio.NewReader(r),
+		opCodes: map[string]int{},
+		Ops:     map[int]string{},
+		Stacks:  map[uint64]*Stack{},
+		Chans:   map[int64]*Chan{},
+		Meta:    map[string]string{},
+
+		Goroutines: map[int64]*Goroutine{},
+	}
+
+	first, err := tr.r.Peek(1)
+	if err == nil && first[0] == '{' {
+		tr.json = true
+		err = tr.readJSONHeader()
+		if err != nil {
+			return nil, err
+		}
+		return tr, nil
+	}
+
+	magic := make([]byte, len(Magic))
+	_, err = io.ReadFull(tr.r, magic)
+	if err != nil || !bytes.Equal(magic, Magic) {
+		return nil, ErrBadMagic
+	}
+
+	tr.Version, err = binary.ReadUvarint(tr.r)
+	if err != nil {
+		return nil, err
+	}
+	if tr.Version > Version {
+		return nil, fmt.Errorf("trace: unsupported version: %d", tr.Version)
+	}
+
+	return tr, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the trace.
+// The returned Event is only valid until the next call to Next().
+func (r *Reader) Next() (*Event, error) {
+	if r.json {
+		return r.nextJSON()
+	}
+
+	for {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if n > MaxRecordSize {
+			return nil, fmt.Errorf("trace: record too large: %d bytes", n)
+		}
+
+		if uint64(cap(r.payload)) < n {
+			r.payload = make([]byte, n)
+		}
+		r.payload = r.payload[:n]
+
+		_, err = io.ReadFull(r.r, r.payload)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		d := &decoder{b: r.payload}
+
+		switch kind {
+		case REC_OP:
+			op := int(d.uvarint())
+			r.Ops[op] = d.string()
+
+		case REC_STACK:
+			s := &Stack{ID: d.uvarint()}
+			s.Text = d.string()
+			s.Site = d.string()
+			r.Stacks[s.ID] = s
+
+		case REC_CHAN:
+			c := &Chan{ID: d.varint()}
+			c.Type = d.string()
+			c.Cap = int(d.varint())
+			c.Name = d.string()
+			c.Site = d.string()
+			for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+				c.Aliases = append(c.Aliases, d.string())
+			}
+			c.Elem = d.string()
+			c.Creator = d.varint()
+			c.CreatedStackID = d.uvarint()
+			for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+				if c.Tags == nil {
+					c.Tags = map[string]string{}
+				}
+				k := d.string()
+				c.Tags[k] = d.string()
+			}
+			r.Chans[c.ID] = c
+
+		case REC_META:
+			key := d.string()
+			r.Meta[key] = d.string()
+
+		case REC_GO:
+			g := &Goroutine{GID: d.varint()}
+			g.Parent = d.varint()
+			g.Func = d.string()
+			g.StackID = d.uvarint()
+			g.Name = d.string()
+			r.Goroutines[g.GID] = g
+
+		case REC_EVENT:
+			e := &Event{Kind: int(d.uvarint())}
+			e.TS = r.lastTS + d.varint()
+			e.GID = d.varint()
+			e.Op = int(d.uvarint())
+			e.CaseNum = int(d.varint())
+			e.ChanID = d.varint()
+			e.Len = int(d.varint())
+			e.Cap = int(d.varint())
+			e.StackID = d.uvarint()
+			flags := d.uvarint()
+			e.Completed = flags&flagCompleted != 0
+			e.Closed = flags&flagClosed != 0
+			e.Panicked = flags&flagPanicked != 0
+			e.Value = d.string()
+			e.Holder = d.varint()
+
+			if d.err != nil {
+				return nil, d.err
+			}
+
+			r.lastTS = e.TS
+
+			return e, nil
+		}
+
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+}
+
+// OpName returns the name of an op, as defined by the trace.
+func (r *Reader) OpName(op int) string {
+	if name, exists := r.Ops[op]; exists {
+		return name
+	}
+	return "op-" + strconv.Itoa(op)
+}
+
+// Stack returns a defined stack, or an empty Stack if unknown.
+func (r *Reader) Stack(id uint64) *Stack {
+	if s := r.Stacks[id]; s != nil {
+		return s
+	}
+	return &Stack{ID: id}
+}
+
+// Chan returns the metadata of a channel, or an empty Chan if
+// unknown.
+func (r *Reader) Chan(id int64) *Chan {
+	if c := r.Chans[id]; c != nil {
+		return c
+	}
+	return &Chan{ID: id}
+}
+
+// Goroutine returns the metadata of a spawned goroutine, or nil if
+// unknown, ex: the main goroutine.
+func (r *Reader) Goroutine(gid int64) *Goroutine {
+	return r.Goroutines[gid]
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
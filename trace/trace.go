@@ -0,0 +1,231 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+// Package trace provides a compact, versioned file format for
+// gapture recordings, with a streaming Writer and Reader.  A JSON
+// Lines format, written by a JSONWriter, is also supported for
+// ad-hoc analysis, and is read by the same Reader.
+//
+// A trace file is a header followed by records.  The header is the
+// Magic bytes and a uvarint Version.  Each record is a record kind
+// byte, a uvarint payload length of at most MaxRecordSize, and the
+// payload.  Payloads are made of varints and length-prefixed
+// strings.  Fields may be appended to a record's payload in later
+// versions, so readers treat missing trailing fields as zero values
+// and skip unknown trailing fields and unknown record kinds.
+//
+// Stacks, channels and op names are defined once by their own
+// records, before the first event that refers to them, and events
+// refer to them by id.  A spawned goroutine is defined by its own
+// record before its spawn event, so that readers can rebuild the
+// tree of goroutines.
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var Magic = []byte("gapture\x00")
+
+const Version = 1
+
+var ErrBadMagic = errors.New("trace: bad magic, not a gapture trace")
+
+// MaxRecordSize is the largest record payload, so that a reader of a
+// corrupt or truncated trace does not allocate without bound.
+const MaxRecordSize = 16 << 20
+
+// Record kinds.
+const (
+	REC_OP    byte = 1
+	REC_STACK byte = 2
+	REC_CHAN  byte = 3
+	REC_EVENT byte = 4
+	REC_META  byte = 5
+	REC_GO    byte = 6
+)
+
+// Event kinds, which match gapture.EventKind.
+const (
+	KIND_BEGIN = 0
+	KIND_END   = 1
+	KIND_SPAWN = 2
+	KIND_EXIT  = 3
+)
+
+var KindStrings = map[int]string{
+	KIND_BEGIN: "begin",
+	KIND_END:   "end",
+	KIND_SPAWN: "spawn",
+	KIND_EXIT:  "exit",
+}
+
+// Event is an operation by a goroutine.
+type Event struct {
+	Kind      int
+	TS        int64 // Nanoseconds since the recording started.
+	GID       int64
+	Op        int
+	CaseNum   int // The select case position, or -1.
+	ChanID    int64
+	Len       int
+	Cap       int
+	StackID   uint64
+	Completed bool
+	Value     string // The encoded message, if values were captured.
+	Closed    bool   // A receive that returned because of a close.
+	Panicked  bool   // An exit of a goroutine that did not return.
+	Holder    int64  // The gid that held the mutex when a lock began.
+}
+
+// Stack is an interned call stack.
+type Stack struct {
+	ID   uint64
+	Text string // In the format of runtime.Stack(), without the header.
+	Site string // The "file.go:line" of the innermost frame.
+}
+
+// Chan is metadata about a channel, which is redefined when it's
+// renamed.
+type Chan struct {
+	ID      int64
+	Type    string // Ex: "chan int".
+	Cap     int
+	Name    string   // Ex: "subtasks", or "" if unnamed.
+	Site    string   // The "file.go:line" where the name was declared.
+	Aliases []string // Other names that the channel was used by.
+	Elem    string   // Ex: "int".
+
+	Tags map[string]string // From gapture.NameChan(), or nil.
+
+	// Creator is the gid of the goroutine that created the channel
+	// by an instrumented make(chan), and CreatedStackID is where.
+	Creator        int64
+	CreatedStackID uint64
+}
+
+// Goroutine is metadata about a spawned or named goroutine, which is
+// redefined when it's renamed.
+type Goroutine struct {
+	GID     int64
+	Parent  int64  // The gid of the spawning goroutine.
+	Func    string // Ex: "main.worker".
+	StackID uint64 // Where the go statement was executed.
+	Name    string // Ex: "main.worker#3", or from gapture.SetName().
+}
+
+// Event flags.
+const (
+	flagCompleted = 1 << iota
+	flagClosed
+	flagPanicked
+)
+
+// An Encoder writes trace records in some format, such as the binary
+// format of a Writer or the JSON Lines format of a JSONWriter.
+type Encoder interface {
+	WriteOp(op int, name string) error
+
+	WriteStack(s *Stack) error
+
+	WriteChan(c *Chan) error
+
+	WriteMeta(key, val string) error
+
+	WriteGoroutine(g *Goroutine) error
+
+	WriteEvent(e *Event) error
+
+	// Flush writes any buffered records to the underlying io.Writer.
+	Flush() error
+}
+
+// Formats of NewEncoder().
+const (
+	FORMAT_BINARY = "binary"
+	FORMAT_JSON   = "json"
+)
+
+// NewEncoder returns an Encoder for the given format, after writing
+// the trace header.
+func NewEncoder(w io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FORMAT_BINARY, "":
+		return NewWriter(w)
+	case FORMAT_JSON:
+		return NewJSONWriter(w)
+	}
+	return nil, fmt.Errorf("trace: unknown format: %q", format)
+}
+
+// ---------------------------------------------------------------
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	return appendUvarint(b, uint64(v<<1)^uint64(v>>63)) // Zig-zag.
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads fields from a record payload, returning zero values
+// for fields beyond the end of the payload.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+var errCorrupt = errors.New("trace: corrupt record")
+
+func (d *decoder) uvarint() uint64 {
+	var v uint64
+	for shift := uint(0); len(d.b) > 0; shift += 7 {
+		c := d.b[0]
+		d.b = d.b[1:]
+		if shift >= 64 {
+			d.err = errCorrupt
+			return 0
+		}
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v
+		}
+	}
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	u := d.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = errCorrupt
+		d.b = nil
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
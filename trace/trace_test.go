@@ -0,0 +1,225 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testStack = &Stack{
+	ID:   7,
+	Text: "main.worker(...)\n\tmain.go:30 +0x1d\n",
+	Site: "main.go:30",
+}
+
+var testChan = &Chan{
+	ID:             3,
+	Type:           "chan int",
+	Cap:            10,
+	Name:           "subtasks",
+	Site:           "main.go:12",
+	Aliases:        []string{"msg.ReplyCh"},
+	Elem:           "int",
+	Tags:           map[string]string{"component": "worker", "kind": "reply"},
+	Creator:        1,
+	CreatedStackID: 7,
+}
+
+var testGoroutine = &Goroutine{
+	GID:     5,
+	Parent:  1,
+	Func:    "main.worker",
+	StackID: 7,
+	Name:    "main.worker#1",
+}
+
+var testEvents = []*Event{
+	{Kind: KIND_SPAWN, TS: 100, GID: 5, Op: 1, CaseNum: -1, StackID: 7},
+	{Kind: KIND_BEGIN, TS: 200, GID: 5, Op: 2, CaseNum: -1, ChanID: 3,
+		Len: 1, Cap: 10, StackID: 7},
+	{Kind: KIND_END, TS: 250, GID: 5, Op: 2, CaseNum: 1, ChanID: 3,
+		Cap: 10, StackID: 7, Completed: true, Closed: true, Value: "42"},
+	{Kind: KIND_BEGIN, TS: 240, GID: 1, Op: 3, CaseNum: -1, ChanID: 4,
+		StackID: 7, Holder: 5},
+	{Kind: KIND_EXIT, TS: 300, GID: 5, Op: 1, CaseNum: -1, StackID: 7,
+		Panicked: true},
+}
+
+func writeTestTrace(t *testing.T, format string) []byte {
+	var buf bytes.Buffer
+
+	enc, err := NewEncoder(&buf, format)
+	if err != nil {
+		t.Fatalf("NewEncoder, err: %v", err)
+	}
+
+	for _, err := range []error{
+		enc.WriteOp(1, "go"),
+		enc.WriteOp(2, "ch-recv"),
+		enc.WriteOp(3, "mu-lock"),
+		enc.WriteMeta("cmd", "main"),
+		enc.WriteStack(testStack),
+		enc.WriteChan(testChan),
+		enc.WriteGoroutine(testGoroutine),
+	} {
+		if err != nil {
+			t.Fatalf("write definition, err: %v", err)
+		}
+	}
+
+	for _, e := range testEvents {
+		if err := enc.WriteEvent(e); err != nil {
+			t.Fatalf("WriteEvent, err: %v", err)
+		}
+	}
+
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush, err: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func testRoundTrip(t *testing.T, format string) {
+	r, err := NewReader(bytes.NewReader(writeTestTrace(t, format)))
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+
+	var events []*Event
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next, err: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	if r.Version != Version {
+		t.Errorf("version, got: %d", r.Version)
+	}
+	if len(events) != len(testEvents) {
+		t.Fatalf("events, got: %d, expected: %d", len(events), len(testEvents))
+	}
+	for i, e := range events {
+		if !reflect.DeepEqual(e, testEvents[i]) {
+			t.Errorf("event %d, got: %+v, expected: %+v", i, e, testEvents[i])
+		}
+	}
+
+	if r.OpName(2) != "ch-recv" || r.OpName(9) != "op-9" {
+		t.Errorf("ops, got: %v", r.Ops)
+	}
+	if r.Meta["cmd"] != "main" {
+		t.Errorf("meta, got: %v", r.Meta)
+	}
+	if !reflect.DeepEqual(r.Stack(7), testStack) {
+		t.Errorf("stack, got: %+v", r.Stack(7))
+	}
+	if !reflect.DeepEqual(r.Chan(3), testChan) {
+		t.Errorf("chan, got: %+v", r.Chan(3))
+	}
+	if !reflect.DeepEqual(r.Goroutine(5), testGoroutine) {
+		t.Errorf("goroutine, got: %+v", r.Goroutine(5))
+	}
+}
+
+func TestRoundTripBinary(t *testing.T) {
+	testRoundTrip(t, FORMAT_BINARY)
+}
+
+func TestRoundTripJSON(t *testing.T) {
+	testRoundTrip(t, FORMAT_JSON)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	b := writeTestTrace(t, FORMAT_BINARY)
+
+	r, err := NewReader(bytes.NewReader(b[:len(b)-3]))
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+
+	for {
+		_, err = r.Next()
+		if err != nil {
+			break
+		}
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
+
+func TestReaderRecordTooLarge(t *testing.T) {
+	b := append([]byte(nil), Magic...)
+	b = appendUvarint(b, Version)
+	b = append(b, REC_EVENT)
+	b = appendUvarint(b, 1<<62)
+
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+
+	_, err = r.Next()
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected record too large, got: %v", err)
+	}
+}
+
+func TestWriterEventTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	enc, err := NewEncoder(&buf, FORMAT_BINARY)
+	if err != nil {
+		t.Fatalf("NewEncoder, err: %v", err)
+	}
+
+	big := &Event{Kind: KIND_END, TS: 500, GID: 5, Op: 2, CaseNum: -1,
+		Value: strings.Repeat("x", MaxRecordSize)}
+	if err = enc.WriteEvent(big); err == nil {
+		t.Fatalf("expected record too large")
+	}
+	if err = enc.WriteEvent(testEvents[0]); err != nil {
+		t.Fatalf("WriteEvent, err: %v", err)
+	}
+	if err = enc.Flush(); err != nil {
+		t.Fatalf("Flush, err: %v", err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+	e, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next, err: %v", err)
+	}
+	if !reflect.DeepEqual(e, testEvents[0]) {
+		t.Errorf("got: %+v, expected: %+v", e, testEvents[0])
+	}
+}
+
+func TestReaderBadMagic(t *testing.T) {
+	_, err := NewReader(strings.NewReader("not a trace"))
+	if err != ErrBadMagic {
+		t.Errorf("expected ErrBadMagic, got: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package trace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A Writer appends records to a binary trace.  A Writer is not
+// concurrency safe.
+type Writer struct {
+	w       *bufio.Writer
+	payload []byte
+	record  []byte
+	lastTS  int64
+}
+
+// NewWriter writes the trace header and returns a Writer.
+func NewWriter(w io.Writer) (*Writer, error) {
+	tw := &Writer{w: bufio.NewWriter(w)}
+
+	header := append([]byte(nil), Magic...)
+	header = appendUvarint(header, Version)
+
+	_, err := tw.w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return tw, nil
+}
+
+func (w *Writer) writeRecord(kind byte, payload []byte) error {
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("trace: record too large: %d bytes", len(payload))
+	}
+
+	w.record = append(w.record[:0], kind)
+	w.record = appendUvarint(w.record, uint64(len(payload)))
+	w.record = append(w.record, payload...)
+
+	_, err := w.w.Write(w.record)
+	return err
+}
+
+// WriteOp defines the name of an op code.
+func (w *Writer) WriteOp(op int, name string) error {
+	p := appendUvarint(w.payload[:0], uint64(op))
+	p = appendString(p, name)
+	w.payload = p
+	return w.writeRecord(REC_OP, p)
+}
+
+// WriteStack defines a stack.
+func (w *Writer) WriteStack(s *Stack) error {
+	p := appendUvarint(w.payload[:0], s.ID)
+	p = appendString(p, s.Text)
+	p = appendString(p, s.Site)
+	w.payload = p
+	return w.writeRecord(REC_STACK, p)
+}
+
+// WriteChan defines or redefines the metadata of a channel.
+func (w *Writer) WriteChan(c *Chan) error {
+	p := appendVarint(w.payload[:0], c.ID)
+	p = appendString(p, c.Type)
+	p = appendVarint(p, int64(c.Cap))
+	p = appendString(p, c.Name)
+	p = appendString(p, c.Site)
+	p = appendUvarint(p, uint64(len(c.Aliases)))
+	for _, alias := range c.Aliases {
+		p = appendString(p, alias)
+	}
+	p = appendString(p, c.Elem)
+	p = appendVarint(p, c.Creator)
+	p = appendUvarint(p, c.CreatedStackID)
+	keys := make([]string, 0, len(c.Tags))
+	for k := range c.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // For deterministic output.
+	p = appendUvarint(p, uint64(len(keys)))
+	for _, k := range keys {
+		p = appendString(p, k)
+		p = appendString(p, c.Tags[k])
+	}
+	w.payload = p
+	return w.writeRecord(REC_CHAN, p)
+}
+
+// WriteMeta records a key/value about the whole recording.
+func (w *Writer) WriteMeta(key, val string) error {
+	p := appendString(w.payload[:0], key)
+	p = appendString(p, val)
+	w.payload = p
+	return w.writeRecord(REC_META, p)
+}
+
+// WriteGoroutine defines or redefines a goroutine.
+func (w *Writer) WriteGoroutine(g *Goroutine) error {
+	p := appendVarint(w.payload[:0], g.GID)
+	p = appendVarint(p, g.Parent)
+	p = appendString(p, g.Func)
+	p = appendUvarint(p, g.StackID)
+	p = appendString(p, g.Name)
+	w.payload = p
+	return w.writeRecord(REC_GO, p)
+}
+
+// WriteEvent appends an event.  Timestamps are delta encoded, so
+// events are most compact when written in timestamp order.
+func (w *Writer) WriteEvent(e *Event) error {
+	var flags uint64
+	if e.Completed {
+		flags |= flagCompleted
+	}
+	if e.Closed {
+		flags |= flagClosed
+	}
+	if e.Panicked {
+		flags |= flagPanicked
+	}
+
+	p := appendUvarint(w.payload[:0], uint64(e.Kind))
+	p = appendVarint(p, e.TS-w.lastTS)
+	p = appendVarint(p, e.GID)
+	p = appendUvarint(p, uint64(e.Op))
+	p = appendVarint(p, int64(e.CaseNum))
+	p = appendVarint(p, e.ChanID)
+	p = appendVarint(p, int64(e.Len))
+	p = appendVarint(p, int64(e.Cap))
+	p = appendUvarint(p, e.StackID)
+	p = appendUvarint(p, flags)
+	if e.Value != "" || e.Holder != 0 {
+		p = appendString(p, e.Value)
+	}
+	if e.Holder != 0 {
+		p = appendVarint(p, e.Holder)
+	}
+	w.payload = p
+
+	if err := w.writeRecord(REC_EVENT, p); err != nil {
+		return err
+	}
+	w.lastTS = e.TS // Only once the reader sees the delta.
+
+	return nil
+}
+
+// Flush writes any buffered records to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,306 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+// TraceSink is an EventSink that streams events into a trace.
+type TraceSink struct {
+	m      sync.Mutex // Protects the fields that follow.
+	w      trace.Encoder
+	chans  map[ChanID]bool  // Channels already defined in the trace.
+	stacks map[StackID]bool // Stacks already defined in the trace.
+	err    error            // The first write error, after which events are dropped.
+
+	// named are the live goroutines defined by WriteGoroutine(), ex:
+	// by SetName(), whose EVENT_SPAWN might be passed to the sink
+	// later and must not redefine them with their automatic names.
+	named map[GID]bool
+}
+
+// StartTrace begins streaming the events of the DefaultRecorder to w
+// in the binary trace format, until the returned TraceSink is
+// stopped.
+func StartTrace(w io.Writer) (*TraceSink, error) {
+	return StartTraceFormat(w, trace.FORMAT_BINARY)
+}
+
+// StartTraceFormat is like StartTrace, but allows the format to be
+// chosen, ex: trace.FORMAT_JSON for JSON Lines.
+func StartTraceFormat(w io.Writer, format string) (*TraceSink, error) {
+	tw, err := trace.NewEncoder(w, format)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TraceSink{w: tw, chans: map[ChanID]bool{}, stacks: map[StackID]bool{},
+		named: map[GID]bool{}}
+
+	var ops []int
+	for op := range OpStrings {
+		ops = append(ops, int(op))
+	}
+	sort.Ints(ops)
+
+	for _, op := range ops {
+		err = tw.WriteOp(op, OpStrings[Op(op)])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.WriteMeta("start",
+		DefaultRecorder.Start().Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, err
+	}
+
+	DefaultRecorder.AddSink(s)
+
+	for _, info := range Goroutines() { // Spawned or named earlier.
+		s.WriteGoroutine(info)
+	}
+
+	if c := CurrentChaos(); c != nil {
+		s.WriteMeta(ChaosSeedMetaKey, strconv.FormatInt(c.Seed, 10))
+	}
+
+	return s, nil
+}
+
+// WriteMeta records a key/value about the whole recording.
+func (s *TraceSink) WriteMeta(key, val string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err == nil {
+		s.err = s.w.WriteMeta(key, val)
+	}
+
+	return s.err
+}
+
+// WriteGoroutine defines or redefines a goroutine, ex: its name.
+func (s *TraceSink) WriteGoroutine(info GoroutineInfo) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.writeGoroutine(info)
+	s.named[info.GID] = true
+
+	return s.err
+}
+
+func (s *TraceSink) writeGoroutine(info GoroutineInfo) {
+	s.writeStack(info.Stack)
+	if s.err == nil {
+		s.err = s.w.WriteGoroutine(&trace.Goroutine{
+			GID:     int64(info.GID),
+			Parent:  int64(info.Parent),
+			Func:    info.Func,
+			Name:    info.Name,
+			StackID: uint64(info.Stack),
+		})
+	}
+}
+
+// WriteChan defines or redefines a channel, ex: its name and tags.
+func (s *TraceSink) WriteChan(info ChanInfo) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.writeChan(info)
+
+	return s.err
+}
+
+func (s *TraceSink) writeChan(info ChanInfo) {
+	s.chans[info.ID] = true
+
+	s.writeStack(info.Created)
+	if s.err == nil {
+		s.err = s.w.WriteChan(&trace.Chan{
+			ID:             int64(info.ID),
+			Type:           info.Type,
+			Cap:            info.Cap,
+			Name:           info.Name,
+			Site:           info.Site,
+			Aliases:        info.Aliases,
+			Tags:           info.Tags,
+			Elem:           info.Elem,
+			Creator:        int64(info.Creator),
+			CreatedStackID: uint64(info.Created),
+		})
+	}
+}
+
+// writeStack defines a stack, if not already.
+func (s *TraceSink) writeStack(stack StackID) {
+	if s.err == nil && stack != 0 && !s.stacks[stack] {
+		s.stacks[stack] = true
+
+		// Stacks are symbolized only here, once per trace.
+		s.err = s.w.WriteStack(&trace.Stack{
+			ID:   uint64(stack),
+			Text: stack.Text(),
+			Site: stack.Site(),
+		})
+	}
+}
+
+// Stop stops the streaming of events and flushes the trace, but does
+// not close the underlying io.Writer.
+func (s *TraceSink) Stop() error {
+	DefaultRecorder.RemoveSink(s)
+
+	return s.Flush()
+}
+
+// Flush writes any buffered events to the underlying io.Writer.
+func (s *TraceSink) Flush() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.err = s.w.Flush()
+
+	return s.err
+}
+
+// Err returns the first error encountered while writing the trace.
+func (s *TraceSink) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.err
+}
+
+func (s *TraceSink) OnEvent(e *Event) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	if e.ChanID != 0 && !s.chans[e.ChanID] {
+		info, _ := DefaultChanRegistry.LookupID(e.ChanID)
+		info.ID = e.ChanID
+		info.Cap = e.Cap
+
+		s.writeChan(info)
+		if s.err != nil {
+			return
+		}
+	}
+
+	if e.Kind == EVENT_EXIT {
+		delete(s.named, e.GID)
+	}
+
+	if e.Kind == EVENT_SPAWN && !s.named[e.GID] {
+		s.writeGoroutine(GoroutineInfo{
+			GID:    e.GID,
+			Name:   e.Name,
+			Parent: e.Parent,
+			Func:   e.Func,
+			Stack:  e.Stack,
+		})
+	}
+
+	s.writeStack(e.Stack)
+	if s.err != nil {
+		return
+	}
+
+	s.err = s.w.WriteEvent(&trace.Event{
+		Kind:      int(e.Kind),
+		TS:        e.TS,
+		GID:       int64(e.GID),
+		Op:        int(e.Op),
+		CaseNum:   e.CaseNum,
+		ChanID:    int64(e.ChanID),
+		Len:       e.Len,
+		Cap:       e.Cap,
+		StackID:   uint64(e.Stack),
+		Completed: e.Completed,
+		Value:     e.Value,
+		Closed:    e.Closed,
+		Panicked:  e.Panicked,
+		Holder:    int64(e.Holder),
+	})
+}
+
+// ---------------------------------------------------------------
+
+// The environment variables that start a trace when the process
+// starts, ex: GAPTURE_TRACE=/tmp/out.gap GAPTURE_TRACE_FORMAT=json.
+// GAPTURE_TRACE_VALUES names one of the ValueEncoders to also capture
+// the sent and received values, ex: GAPTURE_TRACE_VALUES=fmt.
+var (
+	EnvTrace       = "GAPTURE_TRACE"
+	EnvTraceFormat = "GAPTURE_TRACE_FORMAT"
+	EnvTraceValues = "GAPTURE_TRACE_VALUES"
+)
+
+// EnvTraceFlushInterval is how often a trace that was started from
+// the environment is flushed, as the process might exit at any time.
+var EnvTraceFlushInterval = time.Second
+
+func init() {
+	path := os.Getenv(EnvTrace)
+	if path == "" {
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		log.Printf("gapture: could not create %s: %v", path, err)
+		return
+	}
+
+	s, err := StartTraceFormat(f, os.Getenv(EnvTraceFormat))
+	if err != nil {
+		log.Printf("gapture: could not start trace: %v", err)
+		f.Close()
+		return
+	}
+
+	if name := os.Getenv(EnvTraceValues); name != "" {
+		enc := ValueEncoders[name]
+		if enc == nil {
+			log.Printf("gapture: unknown %s: %s", EnvTraceValues, name)
+		}
+		SetValueEncoder(enc)
+	}
+
+	go func() {
+		for range time.Tick(EnvTraceFlushInterval) {
+			if s.Flush() != nil {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/couchbaselabs/gapture/trace"
+)
+
+func TestTraceSinkSpawnKeepsName(t *testing.T) {
+	var buf bytes.Buffer
+
+	s, err := StartTrace(&buf)
+	if err != nil {
+		t.Fatalf("StartTrace, err: %v", err)
+	}
+
+	gid := GID(1 << 40)
+
+	// SetName() ran before the goroutine's EVENT_SPAWN reached the sink.
+	s.WriteGoroutine(GoroutineInfo{GID: gid, Name: "worker-3"})
+	s.OnEvent(&Event{Kind: EVENT_SPAWN, GID: gid, Op: OP_GO, CaseNum: -1,
+		Func: "main.worker", Name: "main.worker#1"})
+
+	if err = s.Stop(); err != nil {
+		t.Fatalf("Stop, err: %v", err)
+	}
+
+	r, err := trace.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader, err: %v", err)
+	}
+	for {
+		if _, err = r.Next(); err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		t.Fatalf("Next, err: %v", err)
+	}
+
+	g := r.Goroutine(int64(gid))
+	if g == nil || g.Name != "worker-3" {
+		t.Errorf("name, got: %+v, expected: worker-3", g)
+	}
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// A ValueEncoder turns a sent or received message into the text that
+// is recorded in the end event of the operation.  An encoder may
+// redact sensitive parts of messages.
+type ValueEncoder interface {
+	EncodeValue(v interface{}) string
+}
+
+// ValueEncoderFunc adapts a func into a ValueEncoder, ex: to redact
+// fields...
+//
+//	gapture.SetValueEncoder(gapture.ValueEncoderFunc(
+//		func(v interface{}) string {
+//			if m, ok := v.(Msg); ok {
+//				m.Body = nil
+//				v = m
+//			}
+//			return gapture.FmtValueEncoder.EncodeValue(v)
+//		}))
+type ValueEncoderFunc func(v interface{}) string
+
+func (f ValueEncoderFunc) EncodeValue(v interface{}) string {
+	return f(v)
+}
+
+// FmtValueEncoder encodes values with fmt's "%v".
+var FmtValueEncoder = ValueEncoderFunc(func(v interface{}) string {
+	return fmt.Sprintf("%v", v)
+})
+
+// JSONValueEncoder encodes values as JSON, falling back to fmt's "%v"
+// for values that can't be marshaled, such as channels.
+var JSONValueEncoder = ValueEncoderFunc(func(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+})
+
+// ValueEncoders are the named ValueEncoder's, ex: for the
+// GAPTURE_TRACE_VALUES environment variable.
+var ValueEncoders = map[string]ValueEncoder{
+	"fmt":  FmtValueEncoder,
+	"json": JSONValueEncoder,
+}
+
+// DefaultValueMaxLen is the max length of an encoded value, beyond
+// which it's truncated.
+var DefaultValueMaxLen = 200
+
+var valueEncoder atomic.Value // Holds a valueEncoderRef.
+
+// valueEncoderRef allows atomic.Value to hold a nil encoder.
+type valueEncoderRef struct {
+	enc ValueEncoder
+}
+
+// SetValueEncoder turns on the capture of sent and received values,
+// which are encoded by enc, or turns it off when enc is nil (the
+// default).
+func SetValueEncoder(enc ValueEncoder) {
+	valueEncoder.Store(valueEncoderRef{enc})
+}
+
+// CurrentValueEncoder returns the ValueEncoder, or nil if values are
+// not captured.
+func CurrentValueEncoder() ValueEncoder {
+	ref, _ := valueEncoder.Load().(valueEncoderRef)
+	return ref.enc
+}
+
+// encodeValue returns the encoded text of a message, or "" when
+// values are not captured.  The text is cut at DefaultValueMaxLen
+// bytes, on a rune boundary.
+func encodeValue(v interface{}) string {
+	enc := CurrentValueEncoder()
+	if enc == nil {
+		return ""
+	}
+	s := enc.EncodeValue(v)
+	if DefaultValueMaxLen > 0 && len(s) > DefaultValueMaxLen {
+		n := DefaultValueMaxLen
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n] + "..."
+	}
+	return s
+}
+
+// setClosed remembers whether a pending receive returned because the
+// channel was closed.
+func (gctx *GCtx) setClosed(i int, closed bool) {
+	if i >= 0 && i < len(gctx.OpCtxs) {
+		gctx.OpCtxs[i].Closed = closed
+	}
+}
+
+// setValue remembers the encoded value of a pending operation.  The
+// value is encoded right away, as a sent message belongs to the
+// receiver once the send completes.
+func (gctx *GCtx) setValue(i int, v interface{}) {
+	if i >= 0 && i < len(gctx.OpCtxs) && gctx.OpCtxs[i].Sampled {
+		gctx.OpCtxs[i].Value = encodeValue(v)
+	}
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEncodeValueTruncatesOnRune(t *testing.T) {
+	defer SetValueEncoder(CurrentValueEncoder())
+	SetValueEncoder(FmtValueEncoder)
+
+	s := encodeValue(strings.Repeat("é", DefaultValueMaxLen))
+	if !utf8.ValidString(s) {
+		t.Errorf("expected valid utf8, got: %q", s)
+	}
+	if len(s) > DefaultValueMaxLen+len("...") {
+		t.Errorf("expected at most %d bytes, got: %d", DefaultValueMaxLen, len(s))
+	}
+}
+
+func TestSetValueEncodesBeforeSend(t *testing.T) {
+	defer SetValueEncoder(CurrentValueEncoder())
+	SetValueEncoder(FmtValueEncoder)
+
+	gctx := &GCtx{OpCtxs: []OpCtx{{Sampled: true}}}
+	m := map[string]int{"a": 1}
+	gctx.setValue(0, m)
+	m["a"] = 2
+
+	if gctx.OpCtxs[0].Value != "map[a:1]" {
+		t.Errorf("value, got: %q, expected: %q", gctx.OpCtxs[0].Value, "map[a:1]")
+	}
+}
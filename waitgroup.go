@@ -0,0 +1,263 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The WaitGroup hooks replace the method calls on sync.WaitGroup
+// values, ex: "wg.Done()" is converted into
+// "gaptureGCtx.OnWGDone(gaptureSite_f_1_2, &wg)", and like the mutex
+// hooks, they perform the operation themselves.
+//
+// The registry tracks the logical counter of each WaitGroup and the
+// goroutines that are accountable for it (ChanInfo.Adders).  In the
+// usual pattern, a parent calls Add() and then spawns the goroutines
+// that call Done(), so a spawned goroutine takes over one of the
+// entries of its parent's most recent Add()'s.  Then a Wait() that
+// blocks is reported along with the goroutines that still owe a
+// Done(), ex: "2 outstanding, adders: main.worker#3, main.worker#5".
+
+func (gctx *GCtx) OnWGAdd(site *Site, wg *sync.WaitGroup, delta int) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_WG_ADD, site, wg)
+	if delta > 0 {
+		DefaultChanRegistry.WaitGroupAdd(wg, adderOf(gctx.GID), delta)
+		handOffs.add(wg, gctx.GID, delta)
+	} else {
+		for i := delta; i < 0; i++ { // Like that many Done()'s.
+			handOffs.done(wg, DefaultChanRegistry.WaitGroupDone(wg, gctx.GID, 0))
+		}
+	}
+	gctx.EndOpCtx(0)
+	wg.Add(delta)
+}
+
+// OnWGDone records the Done() before the counter is actually
+// decremented, so that a released Wait() sees the final counter.
+func (gctx *GCtx) OnWGDone(site *Site, wg *sync.WaitGroup) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_WG_DONE, site, wg)
+	var parent GID
+	if info, ok := LookupGoroutine(gctx.GID); ok {
+		parent = info.Parent
+	}
+	handOffs.done(wg, DefaultChanRegistry.WaitGroupDone(wg, gctx.GID, parent))
+	gctx.EndOpCtx(0)
+	wg.Done()
+}
+
+// OnWGWait is pending while it waits for the counter to reach zero,
+// so it's seen by the stall watchdog, FindDeadlocks() and Snapshot().
+func (gctx *GCtx) OnWGWait(site *Site, wg *sync.WaitGroup) {
+	gctx.DropOpCtxs()
+	gctx.AddOpCtx(OP_WG_WAIT, site, wg)
+	wg.Wait()
+	handOffs.forget(wg)
+	gctx.EndOpCtx(0)
+}
+
+// ---------------------------------------------------------------
+
+// DefaultWaitGroupHandOffs is the most WaitGroups whose Add()'s are
+// tracked for hand-offs, ex: when some are never waited for.
+var DefaultWaitGroupHandOffs = 1024
+
+// handOffs tracks, per WaitGroup, the goroutines of its recent Add()'s
+// whose entries might be taken over by the goroutines that they
+// spawn.  The entries are removed by the matching Done()'s, and all of
+// a WaitGroup's entries by a Wait() that returns.
+var handOffs = &handOffTracker{byWG: map[*sync.WaitGroup][]handOff{}}
+
+type handOffTracker struct {
+	m    sync.Mutex
+	byWG map[*sync.WaitGroup][]handOff // Most recent last.
+	seq  uint64
+}
+
+type handOff struct {
+	gid GID
+	seq uint64 // Orders the hand-offs of all the WaitGroups.
+}
+
+func (t *handOffTracker) add(wg *sync.WaitGroup, gid GID, delta int) {
+	t.m.Lock()
+	entries, exists := t.byWG[wg]
+	if !exists && len(t.byWG) >= DefaultWaitGroupHandOffs {
+		t.evict()
+	}
+	for i := 0; i < delta && i < DefaultWaitGroupAdders; i++ {
+		t.seq++
+		entries = append(entries, handOff{gid: gid, seq: t.seq})
+	}
+	if n := len(entries) - DefaultWaitGroupAdders; n > 0 {
+		entries = append(entries[:0], entries[n:]...)
+	}
+	t.byWG[wg] = entries
+	t.m.Unlock()
+}
+
+// evict forgets the WaitGroup with the least recent Add(), while the
+// tracker is locked.
+func (t *handOffTracker) evict() {
+	var oldest *sync.WaitGroup
+	var oldestSeq uint64
+	for wg, entries := range t.byWG {
+		seq := entries[len(entries)-1].seq
+		if oldest == nil || seq < oldestSeq {
+			oldest, oldestSeq = wg, seq
+		}
+	}
+	delete(t.byWG, oldest)
+}
+
+// reserve is invoked by a go statement, and removes and returns the
+// WaitGroup of its goroutine's most recent Add(), if any, whose
+// Adders entry the spawned goroutine then takes over, see HandOff().
+// It's invoked by the parent rather than the spawned goroutine, so
+// that each go statement follows its own Add().
+func (t *handOffTracker) reserve(parent GID) *sync.WaitGroup {
+	t.m.Lock()
+	var wg *sync.WaitGroup
+	var i int
+	for w, entries := range t.byWG {
+		for j := len(entries) - 1; j >= 0; j-- {
+			if entries[j].gid == parent {
+				if wg == nil || entries[j].seq > t.byWG[wg][i].seq {
+					wg, i = w, j
+				}
+				break
+			}
+		}
+	}
+	if wg != nil {
+		t.remove(wg, i)
+	}
+	t.m.Unlock()
+
+	return wg
+}
+
+// done removes an entry of the goroutine whose Adders entry was
+// removed by a Done(), if the entry was not yet handed off.
+func (t *handOffTracker) done(wg *sync.WaitGroup, removed GID) {
+	if removed == 0 {
+		return
+	}
+
+	t.m.Lock()
+	if i := indexHandOff(t.byWG[wg], removed); i >= 0 {
+		t.remove(wg, i)
+	}
+	t.m.Unlock()
+}
+
+// forget is invoked when a Wait() returns, as the counter is zero.
+func (t *handOffTracker) forget(wg *sync.WaitGroup) {
+	t.m.Lock()
+	delete(t.byWG, wg)
+	t.m.Unlock()
+}
+
+func (t *handOffTracker) remove(wg *sync.WaitGroup, i int) {
+	entries := t.byWG[wg]
+	entries = append(entries[:i], entries[i+1:]...)
+	if len(entries) > 0 {
+		t.byWG[wg] = entries
+	} else {
+		delete(t.byWG, wg)
+	}
+}
+
+func indexHandOff(entries []handOff, gid GID) int {
+	for i, e := range entries {
+		if e.gid == gid {
+			return i
+		}
+	}
+	return -1
+}
+
+// ---------------------------------------------------------------
+
+func adderOf(gid GID) Adder {
+	info, _ := LookupGoroutine(gid)
+	return Adder{GID: gid, Name: info.Name}
+}
+
+// waitGroupAdders returns the distinct goroutines that owe a Done()
+// to the WaitGroup of a Wait() operation, if known.
+func waitGroupAdders(opCtx OpCtx) []Adder {
+	info, ok := DefaultChanRegistry.Lookup(opCtx.Target)
+	if !ok || info.Len <= 0 {
+		return nil
+	}
+
+	var rv []Adder
+	for _, a := range info.Adders {
+		if indexAdder(rv, a.GID) < 0 {
+			rv = append(rv, a)
+		}
+	}
+	return rv
+}
+
+// AdderGIDs returns the GID's of the adders.
+func AdderGIDs(adders []Adder) []GID {
+	rv := make([]GID, 0, len(adders))
+	for _, a := range adders {
+		rv = append(rv, a.GID)
+	}
+	return rv
+}
+
+// AdderNames returns the display names of the adders, where an adder
+// that was known but has since exited is marked, ex:
+// "main.worker#3 (exited)", as it can no longer call Done().
+func AdderNames(adders []Adder) []string {
+	rv := make([]string, 0, len(adders))
+	for _, a := range adders {
+		if a.Name == "" {
+			rv = append(rv, GoroutineName(a.GID))
+		} else if _, alive := LookupGoroutine(a.GID); alive {
+			rv = append(rv, a.Name)
+		} else {
+			rv = append(rv, a.Name+" (exited)")
+		}
+	}
+	return rv
+}
+
+// waitGroupDetail describes the WaitGroup of a Wait() operation, ex:
+// ": 2 outstanding, adders: main.worker#3, main.worker#5", or returns
+// "" for other operations.
+func waitGroupDetail(opCtx OpCtx) string {
+	if opCtx.Op != OP_WG_WAIT {
+		return ""
+	}
+	info, ok := DefaultChanRegistry.Lookup(opCtx.Target)
+	if !ok {
+		return ""
+	}
+	return formatWaitGroup(info.Len, AdderNames(waitGroupAdders(opCtx)))
+}
+
+func formatWaitGroup(outstanding int, adders []string) string {
+	if len(adders) <= 0 {
+		return fmt.Sprintf(": %d outstanding", outstanding)
+	}
+	return fmt.Sprintf(": %d outstanding, adders: %s",
+		outstanding, strings.Join(adders, ", "))
+}
@@ -0,0 +1,148 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func handOffCount(wg *sync.WaitGroup) int {
+	handOffs.m.Lock()
+	defer handOffs.m.Unlock()
+	return len(handOffs.byWG[wg])
+}
+
+func TestWaitGroupHandOffs(t *testing.T) {
+	const (
+		ADD = iota
+		DONE
+		GO
+	)
+
+	type step struct {
+		op    int
+		wg    int // Index of the WaitGroup, for ADD and DONE.
+		delta int
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+
+		// adders are the expected Adders of each WaitGroup, as the
+		// index of the spawned goroutine, or -1 for the parent.
+		adders   [][]int
+		handOffs []int // Expected count of each WaitGroup's entries.
+	}{
+		{"spawn after add",
+			[]step{{ADD, 0, 2}, {GO, 0, 0}, {GO, 0, 0}},
+			[][]int{{0, 1}}, []int{0}},
+		{"more adds than spawns",
+			[]step{{ADD, 0, 3}, {GO, 0, 0}},
+			[][]int{{0, -1, -1}}, []int{2}},
+		{"interleaved waitgroups",
+			[]step{{ADD, 0, 1}, {ADD, 1, 1}, {GO, 0, 0}, {GO, 0, 0}},
+			[][]int{{1}, {0}}, []int{0, 0}},
+		{"parent's own done",
+			[]step{{ADD, 0, 1}, {DONE, 0, 0}, {GO, 0, 0}},
+			[][]int{nil}, []int{0}},
+		{"negative add",
+			[]step{{ADD, 0, 2}, {ADD, 0, -1}, {GO, 0, 0}},
+			[][]int{{0}}, []int{0}},
+	}
+
+	for _, test := range tests {
+		var parent GCtx
+		parent.EnsureGID()
+
+		wgs := make([]sync.WaitGroup, len(test.adders))
+		testKeepAlive = append(testKeepAlive, wgs)
+
+		release := make(chan struct{})
+		gidCh := make(chan GID)
+		var gids []GID
+
+		for _, s := range test.steps {
+			switch s.op {
+			case ADD:
+				parent.OnWGAdd(nil, &wgs[s.wg], s.delta)
+			case DONE:
+				parent.OnWGDone(nil, &wgs[s.wg])
+			case GO:
+				fn := parent.OnGo(func() {
+					gidCh <- CurrentGID()
+					<-release
+				}).(func())
+				go fn()
+				gids = append(gids, <-gidCh)
+			}
+		}
+
+		for i := range wgs {
+			var expected []GID
+			for _, j := range test.adders[i] {
+				if j < 0 {
+					expected = append(expected, parent.GID)
+				} else {
+					expected = append(expected, gids[j])
+				}
+			}
+
+			info, _ := DefaultChanRegistry.Lookup(&wgs[i])
+			got := AdderGIDs(info.Adders)
+			if len(got) != len(expected) ||
+				(len(expected) > 0 && !reflect.DeepEqual(got, expected)) {
+				t.Errorf("%s, wg %d, adders, got: %v, expected: %v",
+					test.name, i, got, expected)
+			}
+
+			if n := handOffCount(&wgs[i]); n != test.handOffs[i] {
+				t.Errorf("%s, wg %d, hand-offs, got: %d, expected: %d",
+					test.name, i, n, test.handOffs[i])
+			}
+		}
+
+		close(release)
+	}
+}
+
+func TestWaitGroupWaitForgets(t *testing.T) {
+	var parent GCtx
+	wg := &sync.WaitGroup{}
+	testKeepAlive = append(testKeepAlive, wg)
+
+	parent.OnWGAdd(nil, wg, 3)
+
+	for i := 0; i < 2; i++ {
+		fn := parent.OnGo(func() {
+			var gctx GCtx
+			gctx.OnWGDone(nil, wg)
+		}).(func())
+		go fn()
+	}
+	parent.OnWGDone(nil, wg)
+
+	parent.OnWGWait(nil, wg)
+
+	info, _ := DefaultChanRegistry.Lookup(wg)
+	if info.Len != 0 || len(info.Adders) != 0 {
+		t.Errorf("expected no outstanding, got: %d, adders: %v", info.Len, info.Adders)
+	}
+	if n := handOffCount(wg); n != 0 {
+		t.Errorf("hand-offs, got: %d, expected: 0", n)
+	}
+	if opCtxs := pendingOf(parent.GID); len(opCtxs) != 0 {
+		t.Errorf("expected no pending ops, got: %+v", opCtxs)
+	}
+}
@@ -0,0 +1,296 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StallReport describes an operation that has been blocked for
+// longer than its stall threshold.
+type StallReport struct {
+	GID     GID
+	Name    string // See GoroutineName().
+	Op      Op
+	CaseNum int // The select case position, or -1.
+	ChanID  ChanID
+	Chan    string // See ChanName().
+	Blocked time.Duration
+	Stack   string
+
+	// Holders are the names of the goroutines that hold the lock
+	// that a lock operation waits for, if known.
+	Holders []string
+
+	// Outstanding is the counter of the WaitGroup that a Wait()
+	// waits for, and Adders are the names of the goroutines that owe
+	// it a Done(), if known.
+	Outstanding int
+	Adders      []string
+}
+
+func (r StallReport) String() string {
+	name := r.Name
+	if name == "" {
+		name = fmt.Sprintf("goroutine %d", r.GID)
+	}
+	chanName := r.Chan
+	if chanName == "" {
+		chanName = fmt.Sprintf("chan #%d", r.ChanID)
+	}
+	detail := ""
+	if len(r.Holders) > 0 {
+		detail = ", held by " + strings.Join(r.Holders, ", ")
+	}
+	if r.Op == OP_WG_WAIT {
+		detail = formatWaitGroup(r.Outstanding, r.Adders)
+	}
+	return fmt.Sprintf("%s blocked for %v on %s of %s%s\n%s",
+		name, r.Blocked, OpStrings[r.Op], chanName, detail, r.Stack)
+}
+
+// StallOptions configures the stall watchdog.
+type StallOptions struct {
+	// Threshold is how long an operation may be blocked before it's
+	// reported as stalled.
+	Threshold time.Duration
+
+	// Thresholds optionally overrides the Threshold for some Op's.
+	Thresholds map[Op]time.Duration
+
+	// Interval is how often the watchdog scans pending operations.
+	Interval time.Duration
+}
+
+var DefaultStallOptions = StallOptions{
+	Threshold: 10 * time.Second,
+	Interval:  time.Second,
+}
+
+// ThresholdFor returns the stall threshold of an Op.
+func (o *StallOptions) ThresholdFor(op Op) time.Duration {
+	if d, exists := o.Thresholds[op]; exists {
+		return d
+	}
+	return o.Threshold
+}
+
+// ---------------------------------------------------------------
+
+// watchdog scans the pending operations of every GCtx and reports
+// stalls to the OnStall() callbacks.
+var watchdog struct {
+	m         sync.Mutex
+	options   StallOptions
+	callbacks []func(StallReport)
+	stopCh    chan struct{}
+	reported  map[stallKey]bool // Stalls already reported.
+}
+
+type stallKey struct {
+	gctx    *GCtx
+	begin   int64
+	caseNum int
+}
+
+func init() {
+	watchdog.options = DefaultStallOptions
+}
+
+// OnStall registers a callback that's invoked with every operation
+// that's blocked longer than its stall threshold, and starts the
+// watchdog if it's not already running.  Each stalled operation is
+// reported once.
+func OnStall(cb func(StallReport)) {
+	watchdog.m.Lock()
+	watchdog.callbacks = append(watchdog.callbacks, cb)
+	if watchdog.stopCh == nil {
+		watchdog.stopCh = make(chan struct{})
+		watchdog.reported = map[stallKey]bool{}
+		go runWatchdog(watchdog.stopCh)
+	}
+	watchdog.m.Unlock()
+}
+
+// SetStallOptions changes the watchdog's configuration, which takes
+// effect on its next scan.
+func SetStallOptions(options StallOptions) {
+	watchdog.m.Lock()
+	watchdog.options = options
+	watchdog.m.Unlock()
+}
+
+// StopWatchdog stops the watchdog and unregisters the callbacks.
+func StopWatchdog() {
+	watchdog.m.Lock()
+	if watchdog.stopCh != nil {
+		close(watchdog.stopCh)
+		watchdog.stopCh = nil
+	}
+	watchdog.callbacks = nil
+	watchdog.reported = nil
+	watchdog.m.Unlock()
+}
+
+func runWatchdog(stopCh chan struct{}) {
+	for {
+		watchdog.m.Lock()
+		interval := watchdog.options.Interval
+		watchdog.m.Unlock()
+
+		if interval <= 0 {
+			interval = DefaultStallOptions.Interval
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		scanStalls(stopCh)
+	}
+}
+
+func scanStalls(stopCh chan struct{}) {
+	watchdog.m.Lock()
+	if watchdog.stopCh != stopCh {
+		watchdog.m.Unlock()
+		return
+	}
+	options := watchdog.options
+	callbacks := watchdog.callbacks
+
+	seen := map[stallKey]bool{}
+	var reports []StallReport
+
+	for _, sp := range findStalls(&options) {
+		k := stallKey{gctx: sp.gctx, begin: sp.begin, caseNum: sp.report.CaseNum}
+		seen[k] = true
+		if !watchdog.reported[k] {
+			watchdog.reported[k] = true
+			reports = append(reports, sp.report)
+		}
+	}
+
+	for k := range watchdog.reported { // Forget stalls that ended.
+		if !seen[k] {
+			delete(watchdog.reported, k)
+		}
+	}
+	watchdog.m.Unlock()
+
+	for _, report := range reports {
+		for _, cb := range callbacks {
+			cb(report)
+		}
+	}
+}
+
+// CheckStalls scans the pending operations of every GCtx once and
+// returns those blocked longer than their thresholds, longest first.
+//
+// When operations are blocked that long, CheckStalls uses
+// runtime.Stack() of all goroutines to learn which goroutines are
+// still alive, which briefly stops the world.
+func CheckStalls(options StallOptions) []StallReport {
+	var rv []StallReport
+	for _, sp := range findStalls(&options) {
+		rv = append(rv, sp.report)
+	}
+	return rv
+}
+
+type stalledOp struct {
+	gctx   *GCtx
+	begin  int64
+	report StallReport
+}
+
+func findStalls(options *StallOptions) []stalledOp {
+	var candidates []*PendingOps
+
+	now := DefaultRecorder.Now()
+
+	for _, p := range pending.all() {
+		for _, opCtx := range p.OpCtxs {
+			if time.Duration(now-opCtx.Begin) >= options.ThresholdFor(opCtx.Op) {
+				candidates = append(candidates, p)
+				break
+			}
+		}
+	}
+
+	if len(candidates) <= 0 {
+		return nil
+	}
+
+	// An operation that was left pending by a recovered panic is not
+	// stalled, so the pending operations of goroutines that have since
+	// exited are forgotten, and those of goroutines that are not
+	// blocked in an operation are skipped.
+	states := goroutineStates()
+
+	var rv []stalledOp
+
+	for _, p := range candidates {
+		state, alive := states[p.GID]
+		if !alive {
+			pending.del(p.GCtx)
+			continue
+		}
+		if !opBlockedState(state) {
+			continue
+		}
+
+		for _, opCtx := range p.OpCtxs {
+			blocked := time.Duration(now - opCtx.Begin)
+			if blocked < options.ThresholdFor(opCtx.Op) {
+				continue
+			}
+
+			report := StallReport{
+				GID:     p.GID,
+				Name:    GoroutineName(p.GID),
+				Op:      opCtx.Op,
+				CaseNum: opCtx.CaseNum,
+				ChanID:  opCtx.ChanID,
+				Chan:    ChanName(opCtx.ChanID),
+				Blocked: blocked,
+				Stack:   opCtx.Stack.Text(),
+				Holders: GoroutineNames(lockHolders(opCtx)),
+			}
+
+			if opCtx.Op == OP_WG_WAIT {
+				info, _ := DefaultChanRegistry.Lookup(opCtx.Target)
+				report.Outstanding = info.Len
+				report.Adders = AdderNames(waitGroupAdders(opCtx))
+			}
+
+			rv = append(rv, stalledOp{
+				gctx:   p.GCtx,
+				begin:  opCtx.Begin,
+				report: report,
+			})
+		}
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].report.Blocked > rv[j].report.Blocked
+	})
+
+	return rv
+}
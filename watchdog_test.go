@@ -0,0 +1,141 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package gapture
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func findStall(reports []StallReport, gid GID) *StallReport {
+	for i := range reports {
+		if reports[i].GID == gid {
+			return &reports[i]
+		}
+	}
+	return nil
+}
+
+func TestCheckStallsThresholds(t *testing.T) {
+	ch := newTestChan(false)
+	gid := blockRecv(ch)
+	defer close(ch)
+	waitBlocked(t, gid)
+
+	tests := []struct {
+		options  StallOptions
+		expected bool
+	}{
+		{StallOptions{}, true},
+		{StallOptions{Threshold: time.Hour}, false},
+		{StallOptions{Threshold: time.Hour,
+			Thresholds: map[Op]time.Duration{OP_CH_RECV: 0}}, true},
+		{StallOptions{Threshold: 0,
+			Thresholds: map[Op]time.Duration{OP_CH_RECV: time.Hour}}, false},
+	}
+
+	for i, test := range tests {
+		r := findStall(CheckStalls(test.options), gid)
+		if (r != nil) != test.expected {
+			t.Errorf("test %d, got: %+v, expected: %v", i, r, test.expected)
+		}
+		if r != nil && (r.Op != OP_CH_RECV || r.CaseNum != -1) {
+			t.Errorf("test %d, got: %+v", i, r)
+		}
+	}
+}
+
+func TestCheckStallsNotBlocked(t *testing.T) {
+	ch := newTestChan(false)
+
+	// A goroutine that exited with a pending op.
+	exitedCh := make(chan GID)
+	go func() {
+		var gctx GCtx
+		gctx.OnChanSend(nil, ch)
+		exitedCh <- gctx.GID
+	}()
+	exited := <-exitedCh
+
+	// A goroutine that's alive but not blocked in its pending op.
+	var stop int32
+	defer atomic.StoreInt32(&stop, 1)
+	runningCh := make(chan GID)
+	go func() {
+		var gctx GCtx
+		gctx.OnChanSend(nil, ch)
+		runningCh <- gctx.GID
+		for atomic.LoadInt32(&stop) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	running := <-runningCh
+
+	for i := 0; i < 1000 && LiveGIDs()[exited]; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	reports := CheckStalls(StallOptions{})
+	if r := findStall(reports, exited); r != nil {
+		t.Errorf("expected no stall of an exited goroutine, got: %+v", r)
+	}
+	if r := findStall(reports, running); r != nil {
+		t.Errorf("expected no stall of a running goroutine, got: %+v", r)
+	}
+
+	if len(pendingOf(exited)) != 0 {
+		t.Errorf("expected the exited goroutine's ops to be forgotten")
+	}
+	if len(pendingOf(running)) != 1 {
+		t.Errorf("expected the running goroutine's op to be kept")
+	}
+}
+
+func TestOnStallReportsOnce(t *testing.T) {
+	ch := newTestChan(false)
+	gid := blockRecv(ch)
+	defer close(ch)
+	waitBlocked(t, gid)
+
+	SetStallOptions(StallOptions{Interval: time.Millisecond})
+	defer SetStallOptions(DefaultStallOptions)
+
+	var m sync.Mutex
+	var count int
+	OnStall(func(r StallReport) {
+		if r.GID == gid {
+			m.Lock()
+			count++
+			m.Unlock()
+		}
+	})
+	defer StopWatchdog()
+
+	for i := 0; i < 1000; i++ {
+		m.Lock()
+		n := count
+		m.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // Several more scans.
+
+	m.Lock()
+	defer m.Unlock()
+	if count != 1 {
+		t.Errorf("reports, got: %d, expected: 1", count)
+	}
+}